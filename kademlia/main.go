@@ -8,6 +8,7 @@ import (
 	"os"
 
 	kadNet "github.com/jessicagreben/kademlia/pkg/network"
+	"github.com/jessicagreben/kademlia/pkg/node"
 	"github.com/jessicagreben/kademlia/pkg/types"
 )
 
@@ -16,7 +17,13 @@ func main() {
 	case "-s":
 		host := os.Args[2]
 		port := os.Args[3]
-		server(host, port)
+
+		// The node ID and the routing table are kept in the optional data directory.
+		dataDir := ""
+		if len(os.Args) > 4 {
+			dataDir = os.Args[4]
+		}
+		server(host, port, dataDir)
 	case "-c":
 		boot := types.Contact{
 			NodeID: types.NodeID{0},
@@ -28,10 +35,63 @@ func main() {
 		if err != nil {
 			os.Exit(1)
 		}
+	case "-put":
+		if len(os.Args) != 6 {
+			fmt.Println("usage: kademlia -put <host> <port> <key> <value>")
+			os.Exit(2)
+		}
+		if err := put(os.Args[2], os.Args[3], os.Args[4], os.Args[5]); err != nil {
+			fmt.Println("put err: ", err)
+			os.Exit(1)
+		}
+	case "-get":
+		if len(os.Args) != 5 {
+			fmt.Println("usage: kademlia -get <host> <port> <key>")
+			os.Exit(2)
+		}
+		if err := get(os.Args[2], os.Args[3], os.Args[4]); err != nil {
+			fmt.Println("get err: ", err)
+			os.Exit(1)
+		}
 	}
 }
 
-func server(host, port string) error {
+// put stores the value at the 160-bit key, written in hex, through the node at host:port.
+func put(host, port, hexKey, value string) error {
+	key, err := node.ParseKey(hexKey)
+	if err != nil {
+		return err
+	}
+
+	c := types.Contact{IP: host, Port: port}
+	stored, err := kadNet.PutValue(c, key, []byte(value))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Stored on %d nodes\n", stored)
+	return nil
+}
+
+// get prints the value stored at the 160-bit key, written in hex, through the node at host:port.
+func get(host, port, hexKey string) error {
+	key, err := node.ParseKey(hexKey)
+	if err != nil {
+		return err
+	}
+
+	c := types.Contact{IP: host, Port: port}
+	value, found, err := kadNet.GetValue(c, key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no value stored at key %s", hexKey)
+	}
+	fmt.Println(string(value))
+	return nil
+}
+
+func server(host, port, dataDir string) error {
 	network := new(kadNet.Network)
 
 	// Publishes the networks methods to the server.
@@ -46,7 +106,7 @@ func server(host, port string) error {
 	}
 
 	fmt.Println("Joining network...")
-	err = network.Join(host, port)
+	err = network.Join(host, port, dataDir)
 	if err != nil {
 		fmt.Println("network.join err: ", err)
 		return err
@@ -4,7 +4,8 @@ import (
 	"github.com/jessicagreben/kademlia/pkg/types"
 )
 
-const k = 20 // Max number of contacts in any one bucket.
+// K is the max number of contacts in any one bucket, and how many contacts a lookup returns.
+const K = 20
 
 // Bucket is container of current contacts the.
 // Most recently contacted is at the end, least recently contacted is at beginning.
@@ -19,16 +20,27 @@ func (b Bucket) Shift() (Bucket, types.Contact) {
 		return b, types.Contact{}
 	}
 
-	return b[:0], b[0]
+	return b[1:], b[0]
+}
+
+// Pop removes the contact that is at the end of the bucket, the most recently contacted.
+func (b Bucket) Pop() (Bucket, types.Contact) {
+
+	// First check that there are any Contacts in this bucket.
+	if len(b) < 1 {
+		return b, types.Contact{}
+	}
+
+	return b[:len(b)-1], b[len(b)-1]
 }
 
 // IsFull checks if the bucket is currently full.
 func (b Bucket) IsFull() bool {
-	if len(b) == k {
+	if len(b) == K {
 		return true
 	}
 
-	// TODO: what if the bucket length is greater than k?
+	// TODO: what if the bucket length is greater than K?
 	return false
 }
 
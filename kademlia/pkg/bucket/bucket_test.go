@@ -23,6 +23,7 @@ func TestShift(t *testing.T) {
 		NodeID: types.NodeID{123},
 	}
 	bNotEmpty := Bucket{d}
+	bMany := setupBucket(3)
 
 	var testCases = []struct {
 		name        string
@@ -32,6 +33,7 @@ func TestShift(t *testing.T) {
 	}{
 		{"empty", bEmpty, types.Contact{}, 0},
 		{"full", bNotEmpty, d, 0},
+		{"many", bMany, bMany[0], 2},
 	}
 
 	for _, tt := range testCases {
@@ -47,6 +49,32 @@ func TestShift(t *testing.T) {
 	}
 }
 
+func TestPop(t *testing.T) {
+	bMany := setupBucket(3)
+
+	var testCases = []struct {
+		name        string
+		bucket      Bucket
+		expectedOut types.Contact
+		expectedLen int
+	}{
+		{"empty", Bucket{}, types.Contact{}, 0},
+		{"many", bMany, bMany[2], 2},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			actualB, actualOut := tt.bucket.Pop()
+			if tt.expectedOut.NodeID != actualOut.NodeID {
+				t.Fatalf("Expect %v, Actual %v", tt.expectedOut.NodeID, actualOut.NodeID)
+			}
+			if tt.expectedLen != len(actualB) {
+				t.Fatalf("Expect %v, Actual %v", tt.expectedLen, len(actualB))
+			}
+		})
+	}
+}
+
 func TestIsFull(t *testing.T) {
 	bEmpty := Bucket{}
 	bFull := setupBucket(20)
@@ -0,0 +1,216 @@
+package network
+
+import (
+	"bytes"
+	"sort"
+
+	b "github.com/jessicagreben/kademlia/pkg/bucket"
+	"github.com/jessicagreben/kademlia/pkg/node"
+	"github.com/jessicagreben/kademlia/pkg/types"
+)
+
+// lookupReply is the reply of a node queried during an iterative lookup.
+type lookupReply struct {
+	contact types.Contact // The contact that was queried.
+	from    types.Contact // The contact the node replied with for itself.
+
+	contacts []types.Contact // The closest contacts to the target the node knows of.
+	value    []byte          // The value stored at the target, when found.
+	found    bool
+	err      error
+}
+
+// queryFunc sends the RPC of a lookup, Lookup or FindValue, to a contact.
+type queryFunc func(c types.Contact) lookupReply
+
+// shortlist holds the contacts of an iterative lookup, sorted by their
+// distance to the target, and what is known about each of them.
+type shortlist struct {
+	target   types.NodeID
+	contacts []types.Contact
+
+	seen      map[types.NodeID]struct{}
+	queried   map[types.NodeID]struct{}
+	responded map[types.NodeID]struct{}
+}
+
+func newShortlist(target types.NodeID, self types.NodeID) *shortlist {
+	return &shortlist{
+		target: target,
+
+		// The current node never queries itself.
+		seen:      map[types.NodeID]struct{}{self: {}},
+		queried:   map[types.NodeID]struct{}{},
+		responded: map[types.NodeID]struct{}{},
+	}
+}
+
+// add adds the contacts that aren't in the shortlist yet and keeps it sorted.
+func (s *shortlist) add(contacts ...types.Contact) {
+	for _, c := range contacts {
+		if _, found := s.seen[c.NodeID]; found {
+			continue
+		}
+		s.seen[c.NodeID] = struct{}{}
+		s.contacts = append(s.contacts, c)
+	}
+	sortByDistance(s.contacts, s.target)
+}
+
+// drop removes a contact that didn't respond from the shortlist.
+// It stays seen, so it isn't added back when other nodes return it.
+func (s *shortlist) drop(id types.NodeID) {
+	for i, c := range s.contacts {
+		if c.NodeID == id {
+			s.contacts = append(s.contacts[:i], s.contacts[i+1:]...)
+			return
+		}
+	}
+}
+
+// next returns up to count of the K closest contacts that haven't been queried
+// yet, and marks them queried.
+func (s *shortlist) next(count int) []types.Contact {
+	batch := []types.Contact{}
+	for i := 0; i < len(s.contacts) && i < b.K && len(batch) < count; i++ {
+		c := s.contacts[i]
+		if _, found := s.queried[c.NodeID]; found {
+			continue
+		}
+		s.queried[c.NodeID] = struct{}{}
+		batch = append(batch, c)
+	}
+	return batch
+}
+
+// closest returns the closest contact to the target, if there is any.
+func (s *shortlist) closest() (types.Contact, bool) {
+	if len(s.contacts) == 0 {
+		return types.Contact{}, false
+	}
+	return s.contacts[0], true
+}
+
+// responsive returns the K closest contacts that responded to the lookup.
+func (s *shortlist) responsive() []types.Contact {
+	contacts := []types.Contact{}
+	for _, c := range s.contacts {
+		if _, found := s.responded[c.NodeID]; found && len(contacts) < b.K {
+			contacts = append(contacts, c)
+		}
+	}
+	return contacts
+}
+
+// iterativeLookup looks for the closest nodes to the target, starting from the
+// contacts given. Each round queries the Alpha closest contacts that haven't
+// been queried yet, at the same time, and adds the contacts they return to the
+// shortlist. Once a round finds no node closer than the closest one found so far,
+// the last rounds query the K closest contacts that haven't been queried yet,
+// still Alpha at a time, and the lookup stops when all of the K closest have
+// been queried. Contacts that don't respond are dropped, so the contacts after
+// them move up into the K closest, and removed from the routing table.
+//
+// It returns the K closest contacts that responded and, when a node replied with
+// the value stored at the target, that reply.
+func (n *Network) iterativeLookup(target types.NodeID, start []types.Contact, query queryFunc) ([]types.Contact, *lookupReply) {
+	s := newShortlist(target, n.rt.currentNode.NodeID)
+	s.add(start...)
+
+	closest, found := s.closest()
+	lastRound := false
+	for {
+		count := node.Alpha
+		if lastRound {
+			count = b.K
+		}
+		batch := s.next(count)
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, reply := range queryAll(batch, query) {
+			if reply.err != nil {
+				s.drop(reply.contact.NodeID)
+				n.rt.remove(reply.contact)
+				continue
+			}
+			s.responded[reply.contact.NodeID] = struct{}{}
+			n.rt.update(reply.from)
+
+			if reply.found {
+				return s.responsive(), &reply
+			}
+			s.add(reply.contacts...)
+		}
+
+		if lastRound {
+			continue
+		}
+		roundClosest, roundFound := s.closest()
+		if roundFound && (!found || closer(target, roundClosest.NodeID, closest.NodeID)) {
+			closest, found = roundClosest, true
+			continue
+		}
+		lastRound = true
+	}
+	return s.responsive(), nil
+}
+
+// queryAll queries the contacts, Alpha of them at the same time, and returns their replies.
+func queryAll(contacts []types.Contact, query queryFunc) []lookupReply {
+	replies := make(chan lookupReply, len(contacts))
+	inFlight := make(chan struct{}, node.Alpha)
+	for _, c := range contacts {
+		inFlight <- struct{}{}
+		go func(c types.Contact) {
+			defer func() { <-inFlight }()
+			reply := query(c)
+			reply.contact = c
+			replies <- reply
+		}(c)
+	}
+
+	all := []lookupReply{}
+	for range contacts {
+		all = append(all, <-replies)
+	}
+	return all
+}
+
+// iterativeFindNode returns the K closest responsive nodes to the target.
+func (n *Network) iterativeFindNode(target types.NodeID, start []types.Contact) []types.Contact {
+	self := n.rt.currentNode
+	contacts, _ := n.iterativeLookup(target, start, func(c types.Contact) lookupReply {
+		l, err := lookup(target, c, self)
+		return lookupReply{from: l.From, contacts: l.Contacts, err: err}
+	})
+	return contacts
+}
+
+// iterativeFindValue returns the value stored at the key, if a node has it.
+func (n *Network) iterativeFindValue(key types.NodeID, start []types.Contact) ([]byte, bool) {
+	self := n.rt.currentNode
+	_, reply := n.iterativeLookup(key, start, func(c types.Contact) lookupReply {
+		r, err := findValue(key, c, self)
+		return lookupReply{from: r.From, contacts: r.Contacts, value: r.Value, found: r.Found, err: err}
+	})
+	if reply == nil {
+		return nil, false
+	}
+	return reply.value, true
+}
+
+// sortByDistance sorts the contacts by the distance of their IDs to the target, closest first.
+func sortByDistance(contacts []types.Contact, target types.NodeID) {
+	sort.SliceStable(contacts, func(i, j int) bool {
+		return closer(target, contacts[i].NodeID, contacts[j].NodeID)
+	})
+}
+
+// closer reports whether id1 is closer to the target than id2.
+func closer(target, id1, id2 types.NodeID) bool {
+	distance1 := node.Distance(target, id1)
+	distance2 := node.Distance(target, id2)
+	return bytes.Compare(distance1[:], distance2[:]) < 0
+}
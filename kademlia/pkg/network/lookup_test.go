@@ -0,0 +1,199 @@
+package network
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	b "github.com/jessicagreben/kademlia/pkg/bucket"
+	"github.com/jessicagreben/kademlia/pkg/node"
+	"github.com/jessicagreben/kademlia/pkg/types"
+)
+
+// fakeNetwork answers the queries of a lookup without RPCs. Every node knows of
+// up to K nodes in each of its buckets, like a routing table, and replies with
+// the K closest it knows of. Dead nodes don't reply.
+type fakeNetwork struct {
+	nodes []types.Contact
+	known map[types.NodeID][]types.Contact
+	dead  map[types.NodeID]bool
+	value map[types.NodeID]bool
+
+	mu       sync.Mutex
+	queries  map[types.NodeID]int
+	inFlight int32
+	maxIn    int32
+}
+
+func newFakeNetwork(seed int64, count int) *fakeNetwork {
+	r := rand.New(rand.NewSource(seed))
+	f := &fakeNetwork{
+		known:   map[types.NodeID][]types.Contact{},
+		dead:    map[types.NodeID]bool{},
+		value:   map[types.NodeID]bool{},
+		queries: map[types.NodeID]int{},
+	}
+	for i := 0; i < count; i++ {
+		id := types.NodeID{}
+		r.Read(id[:])
+		f.nodes = append(f.nodes, types.Contact{NodeID: id})
+	}
+
+	for _, self := range f.nodes {
+		perBucket := map[int]int{}
+		for _, other := range f.nodes {
+			if other.NodeID == self.NodeID {
+				continue
+			}
+			ind := node.FindBucketIndex(self.NodeID, other.NodeID)
+			if perBucket[ind] < b.K {
+				perBucket[ind]++
+				f.known[self.NodeID] = append(f.known[self.NodeID], other)
+			}
+		}
+	}
+	return f
+}
+
+// closest returns the K closest contacts to the target that node knows of.
+func (f *fakeNetwork) closest(id, target types.NodeID) []types.Contact {
+	contacts := append([]types.Contact{}, f.known[id]...)
+	sortByDistance(contacts, target)
+	if len(contacts) > b.K {
+		contacts = contacts[:b.K]
+	}
+	return contacts
+}
+
+func (f *fakeNetwork) query(target types.NodeID) queryFunc {
+	return func(c types.Contact) lookupReply {
+		current := atomic.AddInt32(&f.inFlight, 1)
+		defer atomic.AddInt32(&f.inFlight, -1)
+		f.mu.Lock()
+		f.queries[c.NodeID]++
+		if current > f.maxIn {
+			f.maxIn = current
+		}
+		f.mu.Unlock()
+
+		// Give the other queries of the round the time to start.
+		time.Sleep(time.Millisecond)
+		if f.dead[c.NodeID] {
+			return lookupReply{err: errors.New("connection refused")}
+		}
+		if f.value[c.NodeID] {
+			return lookupReply{value: []byte("value"), found: true}
+		}
+		return lookupReply{contacts: f.closest(c.NodeID, target)}
+	}
+}
+
+// bruteForceClosest returns the K closest live nodes to the target, other than self.
+func (f *fakeNetwork) bruteForceClosest(self, target types.NodeID) []types.Contact {
+	contacts := []types.Contact{}
+	for _, c := range f.nodes {
+		if c.NodeID != self && !f.dead[c.NodeID] {
+			contacts = append(contacts, c)
+		}
+	}
+	sortByDistance(contacts, target)
+	return contacts[:b.K]
+}
+
+func TestIterativeLookup(t *testing.T) {
+	// When nodes are dead, the nodes close to the target reply with dead contacts
+	// among their K closest, so the live nodes just after them may not be found.
+	// The closest ones always are.
+	var testCases = []struct {
+		name        string
+		seed        int64
+		deadCount   int
+		expectedLen int
+	}{
+		{"all alive", 1, 0, b.K},
+		{"some dead", 2, 10, b.K * 3 / 4},
+		{"many dead", 3, 40, b.K / 2},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeNetwork(tt.seed, 200)
+			self := f.nodes[0]
+			for i := 0; i < tt.deadCount; i++ {
+				f.dead[f.nodes[1+i*5].NodeID] = true
+			}
+			n := &Network{rt: newRoutingTable(self)}
+
+			for i := 0; i < 5; i++ {
+				target := f.nodes[100+i].NodeID
+				actualOut, reply := n.iterativeLookup(target, f.closest(self.NodeID, target), f.query(target))
+				if reply != nil {
+					t.Fatalf("Expect %v, Actual %v", nil, reply)
+				}
+
+				// Are the closest live nodes found, in order?
+				expectedOut := f.bruteForceClosest(self.NodeID, target)
+				if len(actualOut) < tt.expectedLen || len(actualOut) > b.K {
+					t.Fatalf("Expect at least %v, Actual %v", tt.expectedLen, len(actualOut))
+				}
+				for j := 0; j < tt.expectedLen; j++ {
+					if actualOut[j].NodeID != expectedOut[j].NodeID {
+						t.Fatalf("Expect %v, Actual %v", expectedOut[j].NodeID, actualOut[j].NodeID)
+					}
+				}
+
+				// Are the dead nodes left out?
+				for _, c := range actualOut {
+					if f.dead[c.NodeID] {
+						t.Fatalf("Expect %v, Actual %v", "live nodes", c.NodeID)
+					}
+				}
+			}
+
+			// Is every node queried at most once per lookup, and never more than Alpha at once?
+			for id, count := range f.queries {
+				if count > 5 {
+					t.Fatalf("Expect at most %v, Actual %v for %v", 5, count, id)
+				}
+			}
+			if f.maxIn > node.Alpha {
+				t.Fatalf("Expect at most %v, Actual %v", node.Alpha, f.maxIn)
+			}
+			if f.maxIn < 2 {
+				t.Fatalf("Expect queries at the same time, Actual %v", f.maxIn)
+			}
+		})
+	}
+}
+
+func TestIterativeLookupFindsValue(t *testing.T) {
+	f := newFakeNetwork(4, 200)
+	self := f.nodes[0]
+	n := &Network{rt: newRoutingTable(self)}
+
+	// The value is stored at the closest node to the key.
+	key := types.NodeID{0x5a, 0x5a}
+	holder := f.bruteForceClosest(self.NodeID, key)[0]
+	f.value[holder.NodeID] = true
+
+	_, reply := n.iterativeLookup(key, f.closest(self.NodeID, key), f.query(key))
+	if reply == nil {
+		t.Fatalf("Expect a reply, Actual %v", reply)
+	}
+	if reply.contact.NodeID != holder.NodeID || string(reply.value) != "value" {
+		t.Fatalf("Expect %v, Actual %v", holder.NodeID, reply.contact.NodeID)
+	}
+}
+
+func TestIterativeLookupWithoutContacts(t *testing.T) {
+	f := newFakeNetwork(5, 1)
+	n := &Network{rt: newRoutingTable(f.nodes[0])}
+
+	actualOut, reply := n.iterativeLookup(types.NodeID{1}, nil, f.query(types.NodeID{1}))
+	if len(actualOut) != 0 || reply != nil {
+		t.Fatalf("Expect %v, Actual %v", 0, len(actualOut))
+	}
+}
@@ -3,82 +3,130 @@ package network
 import (
 	"errors"
 	"fmt"
-	"log"
 	"net/rpc"
 
+	b "github.com/jessicagreben/kademlia/pkg/bucket"
 	"github.com/jessicagreben/kademlia/pkg/node"
+	"github.com/jessicagreben/kademlia/pkg/store"
 	"github.com/jessicagreben/kademlia/pkg/types"
 )
 
 // Network is a x.
 type Network struct {
 	rt *routingTable
-}
 
-// Join creates a node ID, creates a routing table, and populates the routing table for a node.
-func (n *Network) Join(currIP string, currPort string) error {
+	// The values this node stores for the network.
+	values *store.Store
 
-	// Generate an ID for the current node.
-	// TODO: If the ID has been created before, use the previous ID instead of createing a new ID.
-	id := node.GenerateID(types.IDLength)
+	// The directory the node ID and the routing table are saved to, if any.
+	dataDir string
+}
 
-	self := types.Contact{
-		NodeID: id,
-		IP:     currIP,
-		Port:   currPort,
+// Join creates a node ID, creates a routing table, and populates the routing table for a node.
+// With a data directory, the node ID and the routing table are saved to it, and restored
+// from it when the node restarts, see start.
+func (n *Network) Join(currIP string, currPort string, dataDir string) error {
+	restored, err := n.start(currIP, currPort, dataDir)
+	if err != nil {
+		return err
 	}
-
-	// Create a routing table.
-	n.rt = newRoutingTable(self)
 	fmt.Println("route table", n.rt)
 
+	if dataDir != "" {
+		go n.saveEvery(snapshotInterval)
+	}
 	if currIP == "boot" {
 		return nil
 	}
 
 	// Populate the routing table by performing iterative queries to find nodes in the network.
 	// Start by adding self to the bootstrap node routing table. Do this by performing a lookup on self.
-	listContacts, err := lookup(self.NodeID, n.rt.boot, n.rt.currentNode)
+	// A restarted node can still join through its restored contacts if the bootstrap node is down.
+	self := n.rt.currentNode
+	l, err := lookup(self.NodeID, n.rt.boot, self)
 	if err != nil {
-		return err
+		if restored == 0 {
+			return err
+		}
+		fmt.Println("lookup err: ", err)
+	} else {
+		n.rt.update(l.From)
 	}
-	fmt.Println(listContacts)
 
-	if len(listContacts) == 0 {
-		return nil
+	// Next, look for the closest nodes to self, starting from the contacts returned by
+	// the bootstrap node. The nodes queried add self to their routing table.
+	closest := n.iterativeFindNode(self.NodeID, append(n.closestContacts(self.NodeID), l.Contacts...))
+	fmt.Println("closest contacts", closest)
+	return nil
+}
+
+// start creates the routing table and the local store of values of the node.
+// When the data directory holds the state of a previous run, the node keeps its
+// node ID and the saved contacts are revalidated: only those that respond to a
+// ping are added back to the routing table, and the saved state is kept as it
+// is if none of them does. Otherwise a new node ID is generated and saved right
+// away. It returns how many contacts were restored.
+func (n *Network) start(currIP string, currPort string, dataDir string) (int, error) {
+	id, saved, found := types.NodeID{}, []types.Contact{}, false
+	if dataDir != "" {
+		var err error
+		if id, saved, found, err = loadState(dataDir); err != nil {
+			return 0, err
+		}
 	}
 
-	// Next, add self to the closest contacts returned by the bootstrap node.
-	_, err = recursiveLookup(self.NodeID, listContacts, n.rt)
-	if err != nil {
-		return err
+	// Generate an ID for the current node, unless it has been created before.
+	if !found {
+		id = node.GenerateID(types.IDLength)
 	}
-	return nil
+
+	self := types.Contact{
+		NodeID: id,
+		IP:     currIP,
+		Port:   currPort,
+	}
+
+	// Create a routing table and the local store of values.
+	n.rt = newRoutingTable(self)
+	n.values = store.New()
+	n.dataDir = dataDir
+
+	restored := n.rt.revalidate(saved)
+	if dataDir != "" {
+		if err := n.save(); err != nil {
+			return 0, err
+		}
+	}
+	return restored, nil
 }
 
-func lookup(desiredNodeID types.NodeID, otherNode types.Contact, currentNode types.Contact) ([]types.Contact, error) {
+func lookup(desiredNodeID types.NodeID, otherNode types.Contact, currentNode types.Contact) (ListContacts, error) {
 	addr := fmt.Sprintf("%s:%s", otherNode.IP, otherNode.Port)
-	client := client(addr)
+	client, err := client(addr)
+	if err != nil {
+		return ListContacts{}, err
+	}
+	defer client.Close()
 	l := ListContacts{}
 	args := LookupArgs{
 		RequestFrom:   currentNode,
 		DesiredNodeID: desiredNodeID,
 	}
 	if err := client.Call("Network.Lookup", args, &l); err != nil {
-		return []types.Contact{}, err
+		return ListContacts{}, err
 	}
 	if l.Success {
-		fmt.Println("success")
-		return l.Contacts, nil
+		return l, nil
 	}
-	fmt.Println("error")
-	return []types.Contact{}, errors.New(l.ErrMsg)
+	return ListContacts{}, errors.New(l.ErrMsg)
 }
 
 // ListContacts is the response to the Lookup RPC.
+// From is the contact of the node replying.
 type ListContacts struct {
 	Success  bool
 	Found    bool
+	From     types.Contact
 	Contacts []types.Contact
 	ErrMsg   string
 }
@@ -88,6 +136,7 @@ type ListContacts struct {
 func (n *Network) Lookup(a LookupArgs, reply *ListContacts) error {
 	desiredNodeID := a.DesiredNodeID
 	requestFrom := a.RequestFrom
+	reply.From = n.rt.currentNode
 
 	// Look for desired node ID in the route table.
 	c, found := n.rt.find(desiredNodeID)
@@ -97,30 +146,29 @@ func (n *Network) Lookup(a LookupArgs, reply *ListContacts) error {
 		reply.Found = true
 
 		// Update Contact of the node making the request to the route table.
-		n.rt.add(requestFrom)
+		n.rt.update(requestFrom)
 		return nil
 	}
 
 	// If the desiredNodeID is not found in the routing table
 	// then find the closest nodes and return those.
-	xorBytes := node.Distance(desiredNodeID, n.rt.currentNode.NodeID)
-	ind := node.FindLongestPrefix(xorBytes)
-	closestNodes := n.rt.findClosestNodes(ind)
-	reply.Contacts = closestNodes
+	reply.Contacts = n.rt.findClosestNodes(desiredNodeID, b.K)
 	reply.Success = true
 	reply.Found = false
 
 	// Update Contact of the node making the request to the route table.
-	n.rt.add(requestFrom)
+	n.rt.update(requestFrom)
 	return nil
 }
 
-func client(addr string) *rpc.Client {
+// client connects to the RPC server of the node at addr.
+// The caller closes the client once done with it.
+func client(addr string) (*rpc.Client, error) {
 	client, err := rpc.DialHTTP("tcp", addr)
 	if err != nil {
-		log.Fatal("Connection error: ", err)
+		return nil, fmt.Errorf("connection error: %v", err)
 	}
-	return client
+	return client, nil
 }
 
 // Pong is the response to the Ping RPC.
@@ -135,7 +183,11 @@ type Args struct{}
 // Ping is a method to see if a contact is still available.
 func Ping(c types.Contact) (bool, error) {
 	addr := fmt.Sprintf("%s:%s", c.IP, c.Port)
-	client := client(addr)
+	client, err := client(addr)
+	if err != nil {
+		return false, err
+	}
+	defer client.Close()
 	p := Pong{}
 	if err := client.Call("Network.Pong", Args{}, &p); err != nil {
 		fmt.Println("error")
@@ -160,37 +212,3 @@ type LookupArgs struct {
 	RequestFrom   types.Contact
 	DesiredNodeID types.NodeID
 }
-
-func recursiveLookup(desiredNodeID types.NodeID, listContacts []types.Contact, rt *routingTable) (types.Contact, error) {
-	switch len(listContacts) {
-	case 0:
-		return types.Contact{}, nil
-	case 1:
-		currContact := listContacts[0]
-
-		// If the current Contact is the nodeID we're looking for then we are done.
-		if currContact.NodeID == desiredNodeID {
-			return currContact, nil
-		}
-
-		// If the current Contact is not the nodeID we're looking for, then
-		// continue with the recursive search.
-		rt.add(currContact)
-		lcs, err := lookup(desiredNodeID, currContact, rt.currentNode)
-		if err != nil {
-			return types.Contact{}, err
-		}
-		recursiveLookup(desiredNodeID, lcs, rt)
-	default:
-		for _, currContact := range listContacts {
-			rt.add(currContact)
-			lcs, err := lookup(desiredNodeID, currContact, rt.currentNode)
-			if err != nil {
-				return types.Contact{}, err
-			}
-			recursiveLookup(desiredNodeID, lcs, rt)
-		}
-	}
-
-	return types.Contact{}, nil
-}
@@ -0,0 +1,140 @@
+package network
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jessicagreben/kademlia/pkg/node"
+	"github.com/jessicagreben/kademlia/pkg/types"
+)
+
+const (
+	stateFile        = "node.json" // The file in the data directory that keeps the state of the node.
+	snapshotInterval = time.Minute // How often the routing table is saved to the data directory.
+)
+
+// savedState is the state of a node kept across restarts: its ID and the
+// contacts of its buckets, each bucket from least to most recently seen.
+type savedState struct {
+	NodeID   string         `json:"node_id"`
+	Contacts []savedContact `json:"contacts"`
+}
+
+// savedContact is a contact in the state file, its node ID written in hex.
+type savedContact struct {
+	NodeID string `json:"node_id"`
+	IP     string `json:"ip"`
+	Port   string `json:"port"`
+}
+
+// loadState reads the node ID and the contacts saved in the data directory.
+// It returns false if there is no saved state.
+func loadState(dataDir string) (types.NodeID, []types.Contact, bool, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, stateFile))
+	if os.IsNotExist(err) {
+		return types.NodeID{}, nil, false, nil
+	}
+	if err != nil {
+		return types.NodeID{}, nil, false, err
+	}
+
+	state := savedState{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return types.NodeID{}, nil, false, fmt.Errorf("reading %s failed: %v", stateFile, err)
+	}
+	id, err := node.ParseKey(state.NodeID)
+	if err != nil {
+		return types.NodeID{}, nil, false, fmt.Errorf("reading %s failed: node ID: %v", stateFile, err)
+	}
+
+	contacts := []types.Contact{}
+	for i, c := range state.Contacts {
+		contactID, err := node.ParseKey(c.NodeID)
+		if err != nil {
+			return types.NodeID{}, nil, false, fmt.Errorf("reading %s failed: contact %d: %v", stateFile, i+1, err)
+		}
+		contacts = append(contacts, types.Contact{NodeID: contactID, IP: c.IP, Port: c.Port})
+	}
+	return id, contacts, true, nil
+}
+
+// saveState writes the node ID and the contacts of the routing table to the data
+// directory. The state is written to a temporary file first, so a crash while
+// saving leaves the previous state intact.
+func saveState(dataDir string, rt *routingTable) error {
+	state := savedState{
+		NodeID:   hex.EncodeToString(rt.currentNode.NodeID[:]),
+		Contacts: []savedContact{},
+	}
+	for _, c := range rt.contacts() {
+		state.Contacts = append(state.Contacts, savedContact{NodeID: hex.EncodeToString(c.NodeID[:]), IP: c.IP, Port: c.Port})
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return err
+	}
+	path := filepath.Join(dataDir, stateFile)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// revalidate adds the saved contacts that respond to a ping to the routing
+// table, in the order they were saved, so each bucket keeps its order from
+// least to most recently seen. Up to Alpha contacts are pinged at the same time.
+// It returns how many contacts were added.
+func (rt *routingTable) revalidate(saved []types.Contact) int {
+	responsive := make([]bool, len(saved))
+	done := make(chan struct{}, len(saved))
+	inFlight := make(chan struct{}, node.Alpha)
+	for i, c := range saved {
+		inFlight <- struct{}{}
+		go func(i int, c types.Contact) {
+			defer func() { <-inFlight }()
+			responsive[i] = rt.ping(c)
+			done <- struct{}{}
+		}(i, c)
+	}
+	for range saved {
+		<-done
+	}
+
+	added := 0
+	for i, c := range saved {
+		if responsive[i] && rt.update(c) == nil {
+			added++
+		}
+	}
+	return added
+}
+
+// save saves the state of the node to the data directory. A routing table
+// without contacts is not saved over the state of a previous run: its contacts
+// may only be down for a while, e.g when the whole network restarts, and are
+// revalidated again on the next start.
+func (n *Network) save() error {
+	if len(n.rt.contacts()) == 0 {
+		if _, err := os.Stat(filepath.Join(n.dataDir, stateFile)); err == nil {
+			return nil
+		}
+	}
+	return saveState(n.dataDir, n.rt)
+}
+
+// saveEvery saves the state of the node to the data directory at every interval.
+func (n *Network) saveEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := n.save(); err != nil {
+			fmt.Println("saveState err: ", err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package network
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jessicagreben/kademlia/pkg/types"
+)
+
+// deadContact returns the contact of a node that doesn't listen anymore.
+func deadContact(t *testing.T, id types.NodeID) types.Contact {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	ln.Close()
+	return types.Contact{NodeID: id, IP: host, Port: port}
+}
+
+func TestStartKeepsNodeID(t *testing.T) {
+	dir := t.TempDir()
+
+	var testCases = []struct {
+		name        string
+		dataDir     string
+		expectedOut bool
+	}{
+		{"with a data directory", dir, true},
+		{"without a data directory", "", false},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			first, second := &Network{}, &Network{}
+			if _, err := first.start("127.0.0.1", "8080", tt.dataDir); err != nil {
+				t.Fatalf("Expect %v, Actual %v", nil, err)
+			}
+			if _, err := second.start("127.0.0.1", "8080", tt.dataDir); err != nil {
+				t.Fatalf("Expect %v, Actual %v", nil, err)
+			}
+
+			actualOut := first.rt.currentNode.NodeID == second.rt.currentNode.NodeID
+			if actualOut != tt.expectedOut {
+				t.Fatalf("Expect %v, Actual %v", tt.expectedOut, actualOut)
+			}
+		})
+	}
+}
+
+func TestStartRevalidatesContacts(t *testing.T) {
+	dir := t.TempDir()
+	first := &Network{}
+	if _, err := first.start("127.0.0.1", "8080", dir); err != nil {
+		t.Fatalf("Expect %v, Actual %v", nil, err)
+	}
+
+	// Case setup: two live nodes and a dead one in the saved routing table.
+	live := []types.Contact{
+		startNode(t, types.NodeID{0x80, 1}).rt.currentNode,
+		startNode(t, types.NodeID{0x80, 2}).rt.currentNode,
+	}
+	dead := deadContact(t, types.NodeID{0x80, 3})
+	first.rt.update(live[1])
+	first.rt.update(dead)
+	first.rt.update(live[0])
+	if err := saveState(dir, first.rt); err != nil {
+		t.Fatalf("Expect %v, Actual %v", nil, err)
+	}
+
+	restarted := &Network{}
+	restored, err := restarted.start("127.0.0.1", "8080", dir)
+	if err != nil {
+		t.Fatalf("Expect %v, Actual %v", nil, err)
+	}
+
+	// Are only the live contacts restored, in the order they were seen?
+	if restored != 2 {
+		t.Fatalf("Expect %v, Actual %v", 2, restored)
+	}
+	actualOut := restarted.rt.contacts()
+	expectedOut := []types.Contact{live[1], live[0]}
+	if len(actualOut) != len(expectedOut) {
+		t.Fatalf("Expect %v, Actual %v", expectedOut, actualOut)
+	}
+	for i := range expectedOut {
+		if actualOut[i] != expectedOut[i] {
+			t.Fatalf("Expect %v, Actual %v", expectedOut[i], actualOut[i])
+		}
+	}
+
+	// Is the revalidated routing table saved again?
+	_, saved, _, err := loadState(dir)
+	if err != nil || len(saved) != 2 {
+		t.Fatalf("Expect %v, Actual %v %v", 2, len(saved), err)
+	}
+}
+
+func TestStartWithEveryContactDown(t *testing.T) {
+	dir := t.TempDir()
+	first := &Network{}
+	if _, err := first.start("127.0.0.1", "8080", dir); err != nil {
+		t.Fatalf("Expect %v, Actual %v", nil, err)
+	}
+
+	// Case setup: only dead nodes in the saved routing table, as when every node restarts at once.
+	first.rt.update(deadContact(t, types.NodeID{0x80, 1}))
+	first.rt.update(deadContact(t, types.NodeID{0x80, 2}))
+	if err := saveState(dir, first.rt); err != nil {
+		t.Fatalf("Expect %v, Actual %v", nil, err)
+	}
+
+	restarted := &Network{}
+	restored, err := restarted.start("127.0.0.1", "8080", dir)
+	if err != nil || restored != 0 {
+		t.Fatalf("Expect %v %v, Actual %v %v", 0, nil, restored, err)
+	}
+
+	// Are the saved contacts kept, on start and on the next periodic save, so the next start tries them again?
+	if err := restarted.save(); err != nil {
+		t.Fatalf("Expect %v, Actual %v", nil, err)
+	}
+	id, saved, _, err := loadState(dir)
+	if err != nil || len(saved) != 2 || id != first.rt.currentNode.NodeID {
+		t.Fatalf("Expect %v, Actual %v %v", 2, len(saved), err)
+	}
+}
+
+func TestLoadState(t *testing.T) {
+	var testCases = []struct {
+		name          string
+		content       string
+		expectedFound bool
+		expectedErr   bool
+	}{
+		{"no state", "", false, false},
+		{"valid", `{"node_id": "0100000000000000000000000000000000000000", "contacts": [{"node_id": "0200000000000000000000000000000000000000", "ip": "node1", "port": "8081"}]}`, true, false},
+		{"bad node ID", `{"node_id": "01", "contacts": []}`, false, true},
+		{"bad contact", `{"node_id": "0100000000000000000000000000000000000000", "contacts": [{"node_id": "zz"}]}`, false, true},
+		{"not JSON", `node`, false, true},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.content != "" {
+				if err := os.WriteFile(filepath.Join(dir, stateFile), []byte(tt.content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			id, contacts, actualFound, err := loadState(dir)
+			if (err != nil) != tt.expectedErr {
+				t.Fatalf("Expect error %v, Actual %v", tt.expectedErr, err)
+			}
+			if actualFound != tt.expectedFound {
+				t.Fatalf("Expect %v, Actual %v", tt.expectedFound, actualFound)
+			}
+			if actualFound && (id != types.NodeID{1} || len(contacts) != 1 || contacts[0].IP != "node1") {
+				t.Fatalf("Expect %v, Actual %v %v", types.NodeID{1}, id, contacts)
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package network
 
 import (
+	"errors"
+	"fmt"
 	"sync"
 
 	b "github.com/jessicagreben/kademlia/pkg/bucket"
@@ -23,6 +25,13 @@ type routingTable struct {
 	// One bucket for each bit in the current node's ID.
 	buckets [bucketCount]b.Bucket
 
+	// The replacement cache of each bucket: the contacts heard from while the
+	// bucket was full, least recently seen first. Up to K are kept.
+	replacements [bucketCount]b.Bucket
+
+	// ping checks if a contact is still responsive.
+	ping func(c types.Contact) bool
+
 	mu sync.Mutex
 }
 
@@ -32,12 +41,13 @@ func newRoutingTable(c types.Contact) *routingTable {
 		IP:     "boot",
 		Port:   "8080",
 	}
-	var mu sync.Mutex
-
 	rt := routingTable{
 		currentNodesInBucket: map[types.NodeID]struct{}{},
 		boot:                 boot,
-		mu:                   mu,
+		ping: func(c types.Contact) bool {
+			responsive, _ := Ping(c)
+			return responsive
+		},
 	}
 
 	for i := 0; i < types.IDLength; i++ {
@@ -47,77 +57,206 @@ func newRoutingTable(c types.Contact) *routingTable {
 	return &rt
 }
 
-func (rt *routingTable) find(id types.NodeID) (types.Contact, bool) {
-	_, found := rt.currentNodesInBucket[id]
+// bucketIndex returns the index of the bucket for the node ID. The current node
+// has no bucket.
+func (rt *routingTable) bucketIndex(id types.NodeID) (int, bool) {
 	ind := node.FindBucketIndex(id, rt.currentNode.NodeID)
-	bucket := rt.buckets[ind]
-	_, c, found := bucket.Find(id)
+	return ind, ind < bucketCount
+}
+
+func (rt *routingTable) find(id types.NodeID) (types.Contact, bool) {
+	ind, ok := rt.bucketIndex(id)
+	if !ok {
+		return types.Contact{}, false
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	_, c, found := rt.buckets[ind].Find(id)
 	if found {
 		return c, true
 	}
 	return types.Contact{}, false
 }
 
-func (rt *routingTable) add(newContact types.Contact) b.Bucket {
-	ind := node.FindBucketIndex(newContact.NodeID, rt.currentNode.NodeID)
-	bucket := rt.buckets[ind]
-
-	// If the bucket is currently full, then ping each contact to see if it is
-	// still responsive. If it isn't then remove it and add the new contact.
-	if bucket.IsFull() {
-
-		// Ping each contact in the bucket.
-		for ind, existingContact := range bucket {
-			responsive, _ := Ping(existingContact)
-
-			// If an existing contact is not responsive,
-			// then remove it and add the new contact.
-			if !responsive {
-				bucket = bucket.Remove(ind)
-				break
-			}
-
-			// If all existing contacts are responsive then ignore
-			// the new contact and do not add it.
-			if ind == len(bucket)-1 {
-				return bucket
-			}
-		}
-	}
-	bucket = bucket.Push(newContact)
+// contacts returns the contacts of every bucket, each bucket from least to most
+// recently seen.
+func (rt *routingTable) contacts() []types.Contact {
 	rt.mu.Lock()
-	rt.currentNodesInBucket[newContact.NodeID] = struct{}{}
-	rt.mu.Unlock()
+	defer rt.mu.Unlock()
 
-	rt.buckets[ind] = bucket
-	return bucket
+	contacts := []types.Contact{}
+	for _, bucket := range rt.buckets {
+		contacts = append(contacts, bucket...)
+	}
+	return contacts
 }
 
+// update records that the current node heard from the contact. A contact that is
+// in its bucket already moves to the tail, as the most recently seen. Otherwise
+// the contact is added, see add.
 func (rt *routingTable) update(c types.Contact) error {
+	ind, ok := rt.bucketIndex(c.NodeID)
+	if !ok {
+		return errors.New("the current node is not in its own routing table")
+	}
+	if c.IP == "" {
+		return fmt.Errorf("contact %x has no address", c.NodeID)
+	}
+
+	rt.mu.Lock()
+	if _, _, found := rt.buckets[ind].Find(c.NodeID); found {
+		rt.push(ind, c)
+		rt.mu.Unlock()
+		return nil
+	}
+	rt.mu.Unlock()
+
+	rt.add(c)
 	return nil
 }
 
+// add adds a new contact at the tail of its bucket. If the bucket is full, only
+// the least recently seen contact, at the head, is pinged. If it responds, it
+// moves to the tail and the new contact goes to the replacement cache of the
+// bucket. If it doesn't respond, it's evicted and the new contact is added.
+func (rt *routingTable) add(newContact types.Contact) b.Bucket {
+	ind, ok := rt.bucketIndex(newContact.NodeID)
+	if !ok {
+		return nil
+	}
+
+	rt.mu.Lock()
+	if !rt.buckets[ind].IsFull() {
+		defer rt.mu.Unlock()
+		rt.push(ind, newContact)
+		return rt.buckets[ind]
+	}
+	head := rt.buckets[ind][0]
+	rt.mu.Unlock()
+
+	// Don't hold the lock while waiting for the ping, the bucket may change meanwhile.
+	responsive := rt.ping(head)
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if responsive {
+		if _, _, found := rt.buckets[ind].Find(head.NodeID); found {
+			rt.push(ind, head)
+		}
+		rt.addReplacement(ind, newContact)
+		return rt.buckets[ind]
+	}
+
+	rt.evict(ind, head.NodeID)
+	if rt.buckets[ind].IsFull() {
+		rt.addReplacement(ind, newContact)
+	} else {
+		rt.push(ind, newContact)
+	}
+	return rt.buckets[ind]
+}
+
+// remove evicts a contact that isn't responsive from its bucket and from the
+// replacement cache. The most recently seen contact of the replacement cache
+// takes its place in the bucket.
 func (rt *routingTable) remove(c types.Contact) b.Bucket {
-	return nil
+	ind, ok := rt.bucketIndex(c.NodeID)
+	if !ok {
+		return nil
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if i, _, found := rt.replacements[ind].Find(c.NodeID); found {
+		rt.replacements[ind] = rt.replacements[ind].Remove(i)
+	}
+	if _, _, found := rt.buckets[ind].Find(c.NodeID); !found {
+		return rt.buckets[ind]
+	}
+
+	rt.evict(ind, c.NodeID)
+	if len(rt.replacements[ind]) > 0 {
+		var replacement types.Contact
+		rt.replacements[ind], replacement = rt.replacements[ind].Pop()
+		rt.push(ind, replacement)
+	}
+	return rt.buckets[ind]
 }
 
-func (rt *routingTable) findClosestNodes(xorPrefix int) []types.Contact {
+// push moves the contact to the tail of its bucket, adding it if needed.
+// The caller holds the lock.
+func (rt *routingTable) push(ind int, c types.Contact) {
+	if i, _, found := rt.buckets[ind].Find(c.NodeID); found {
+		rt.buckets[ind] = rt.buckets[ind].Remove(i)
+	}
+	if i, _, found := rt.replacements[ind].Find(c.NodeID); found {
+		rt.replacements[ind] = rt.replacements[ind].Remove(i)
+	}
+	rt.buckets[ind] = rt.buckets[ind].Push(c)
+	rt.currentNodesInBucket[c.NodeID] = struct{}{}
+}
+
+// evict removes the contact from its bucket. The caller holds the lock.
+func (rt *routingTable) evict(ind int, id types.NodeID) {
+	if i, _, found := rt.buckets[ind].Find(id); found {
+		rt.buckets[ind] = rt.buckets[ind].Remove(i)
+	}
+	delete(rt.currentNodesInBucket, id)
+}
 
-	// First look for the closest nodes.
-	for i := xorPrefix; i >= 0; i-- {
-		currBucket := rt.buckets[i]
-		if len(currBucket) > 0 {
-			return currBucket
+// addReplacement moves the contact to the tail of the replacement cache of the
+// bucket, dropping the least recently seen when it's full. The caller holds the lock.
+func (rt *routingTable) addReplacement(ind int, c types.Contact) {
+	cache := rt.replacements[ind]
+	if i, _, found := cache.Find(c.NodeID); found {
+		cache = cache.Remove(i)
+	}
+	if cache.IsFull() {
+		cache, _ = cache.Shift()
+	}
+	rt.replacements[ind] = cache.Push(c)
+}
+
+// findClosestNodes returns up to count contacts of the routing table, sorted by
+// their XOR distance to the target, closest first.
+//
+// Say the target falls in bucket p: its ID and the current node ID share a prefix
+// of p bits. The contacts of bucket p share more than p bits with the target, so
+// they are the closest. The contacts of the buckets after p share exactly p bits
+// with the target, and the contacts of a bucket i before p share exactly i bits.
+// So the buckets are ranked p, then every bucket after p, then p-1 down to 0, and
+// only the contacts within a rank need to be sorted.
+func (rt *routingTable) findClosestNodes(target types.NodeID, count int) []types.Contact {
+	p := node.FindBucketIndex(target, rt.currentNode.NodeID)
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	ranks := [][]types.Contact{}
+	if p < bucketCount {
+		ranks = append(ranks, rt.buckets[p])
+		after := []types.Contact{}
+		for i := p + 1; i < bucketCount; i++ {
+			after = append(after, rt.buckets[i]...)
 		}
+		ranks = append(ranks, after)
+	}
+	for i := p - 1; i >= 0; i-- {
+		ranks = append(ranks, rt.buckets[i])
 	}
 
-	// If there aren't any "close" nodes, then return
-	// any nodes.
-	for i := xorPrefix + 1; i < bucketCount; i++ {
-		currBucket := rt.buckets[i]
-		if len(currBucket) > 0 {
-			return currBucket
+	closest := []types.Contact{}
+	for _, rank := range ranks {
+		if len(closest) >= count {
+			break
 		}
+		contacts := append([]types.Contact{}, rank...)
+		sortByDistance(contacts, target)
+		closest = append(closest, contacts...)
+	}
+	if len(closest) > count {
+		closest = closest[:count]
 	}
-	return []types.Contact{}
+	return closest
 }
@@ -0,0 +1,287 @@
+package network
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	b "github.com/jessicagreben/kademlia/pkg/bucket"
+	"github.com/jessicagreben/kademlia/pkg/node"
+	"github.com/jessicagreben/kademlia/pkg/types"
+)
+
+// randomID returns a random node ID.
+func randomID(r *rand.Rand) types.NodeID {
+	id := types.NodeID{}
+	r.Read(id[:])
+	return id
+}
+
+// setupRoutingTable returns a routing table holding up to contactCount contacts
+// with random IDs, and the contacts it holds. Contacts of a full bucket are left out.
+func setupRoutingTable(r *rand.Rand, self types.NodeID, contactCount int) (*routingTable, []types.Contact) {
+	rt := newRoutingTable(types.Contact{NodeID: self})
+	contacts := []types.Contact{}
+	for i := 0; i < contactCount; i++ {
+		c := types.Contact{NodeID: randomID(r)}
+		ind := node.FindBucketIndex(c.NodeID, self)
+		if ind == bucketCount || rt.buckets[ind].IsFull() {
+			continue
+		}
+		rt.buckets[ind] = rt.buckets[ind].Push(c)
+		contacts = append(contacts, c)
+	}
+	return rt, contacts
+}
+
+// bruteForceClosestNodes ranks every contact by its XOR distance to the target
+// and returns the first count of them.
+func bruteForceClosestNodes(contacts []types.Contact, target types.NodeID, count int) []types.Contact {
+	sorted := append([]types.Contact{}, contacts...)
+	sort.Slice(sorted, func(i, j int) bool {
+		distanceI := node.Distance(sorted[i].NodeID, target)
+		distanceJ := node.Distance(sorted[j].NodeID, target)
+		return bytes.Compare(distanceI[:], distanceJ[:]) < 0
+	})
+	if len(sorted) > count {
+		sorted = sorted[:count]
+	}
+	return sorted
+}
+
+func TestFindClosestNodes(t *testing.T) {
+	var testCases = []struct {
+		name         string
+		seed         int64
+		contactCount int
+		count        int
+		target       string
+	}{
+		{"empty table", 1, 0, b.K, "random"},
+		{"fewer contacts than count", 2, 5, b.K, "random"},
+		{"one closest", 3, 200, 1, "random"},
+		{"alpha closest", 4, 200, node.Alpha, "random"},
+		{"k closest", 5, 200, b.K, "random"},
+		{"k closest of many", 6, 2000, b.K, "random"},
+		{"target is self", 7, 200, b.K, "self"},
+		{"target is a contact", 8, 200, b.K, "contact"},
+		{"target close to self", 9, 2000, b.K, "near self"},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := rand.New(rand.NewSource(tt.seed))
+			self := randomID(r)
+			rt, contacts := setupRoutingTable(r, self, tt.contactCount)
+
+			for i := 0; i < 20; i++ {
+				target := randomID(r)
+				switch tt.target {
+				case "self":
+					target = self
+				case "contact":
+					target = contacts[r.Intn(len(contacts))].NodeID
+				case "near self":
+					target = self
+					target[types.IDLength-1] ^= byte(1 + r.Intn(255))
+				}
+
+				actualOut := rt.findClosestNodes(target, tt.count)
+				expectedOut := bruteForceClosestNodes(contacts, target, tt.count)
+				if len(expectedOut) != len(actualOut) {
+					t.Fatalf("Expect %v, Actual %v", len(expectedOut), len(actualOut))
+				}
+				for j := range expectedOut {
+					if expectedOut[j].NodeID != actualOut[j].NodeID {
+						t.Fatalf("Expect %v, Actual %v", expectedOut[j].NodeID, actualOut[j].NodeID)
+					}
+				}
+			}
+		})
+	}
+}
+
+// fakePinger answers the pings of a routing table without RPCs.
+type fakePinger struct {
+	dead   map[types.NodeID]bool
+	pinged []types.NodeID
+}
+
+func (f *fakePinger) ping(c types.Contact) bool {
+	f.pinged = append(f.pinged, c.NodeID)
+	return !f.dead[c.NodeID]
+}
+
+// bucketContact returns a contact that falls in bucket 0 of a node with the zero ID.
+func bucketContact(i int) types.Contact {
+	return types.Contact{NodeID: types.NodeID{0x80, byte(i)}, IP: "127.0.0.1", Port: "8080"}
+}
+
+// setupFullBucket returns a routing table, for a node with the zero ID, with a
+// full bucket 0 of the contacts 0 to K-1, contact 0 the least recently seen.
+func setupFullBucket(f *fakePinger) *routingTable {
+	rt := newRoutingTable(types.Contact{})
+	rt.ping = f.ping
+	for i := 0; i < b.K; i++ {
+		rt.update(bucketContact(i))
+	}
+	return rt
+}
+
+// ids returns the node IDs of the contacts, in order.
+func ids(contacts []types.Contact) []types.NodeID {
+	out := []types.NodeID{}
+	for _, c := range contacts {
+		out = append(out, c.NodeID)
+	}
+	return out
+}
+
+func TestUpdate(t *testing.T) {
+	var testCases = []struct {
+		name                 string
+		dead                 []int
+		updates              []int
+		expectedHead         int
+		expectedTail         int
+		expectedPinged       []int
+		expectedReplacements []int
+	}{
+		{"known contact moves to the tail", nil, []int{0}, 1, 0, nil, nil},
+		{"alive head stays", nil, []int{b.K}, 1, 0, []int{0}, []int{b.K}},
+		{"dead head is evicted", []int{0}, []int{b.K}, 1, b.K, []int{0}, nil},
+		{"only the head is pinged", []int{1}, []int{b.K, b.K + 1}, 2, b.K + 1, []int{0, 1}, []int{b.K}},
+		{"replacement seen again moves to the tail", nil, []int{b.K, b.K + 1, b.K}, 3, 2, []int{0, 1, 2}, []int{b.K + 1, b.K}},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakePinger{dead: map[types.NodeID]bool{}}
+			for _, i := range tt.dead {
+				f.dead[bucketContact(i).NodeID] = true
+			}
+			rt := setupFullBucket(f)
+
+			for _, i := range tt.updates {
+				if err := rt.update(bucketContact(i)); err != nil {
+					t.Fatalf("Expect %v, Actual %v", nil, err)
+				}
+			}
+
+			bucket := rt.buckets[0]
+			if len(bucket) != b.K {
+				t.Fatalf("Expect %v, Actual %v", b.K, len(bucket))
+			}
+			if bucket[0].NodeID != bucketContact(tt.expectedHead).NodeID {
+				t.Fatalf("Expect %v, Actual %v", bucketContact(tt.expectedHead).NodeID, bucket[0].NodeID)
+			}
+			if bucket[len(bucket)-1].NodeID != bucketContact(tt.expectedTail).NodeID {
+				t.Fatalf("Expect %v, Actual %v", bucketContact(tt.expectedTail).NodeID, bucket[len(bucket)-1].NodeID)
+			}
+
+			expectedPinged := []types.NodeID{}
+			for _, i := range tt.expectedPinged {
+				expectedPinged = append(expectedPinged, bucketContact(i).NodeID)
+			}
+			if !reflect.DeepEqual(expectedPinged, append([]types.NodeID{}, f.pinged...)) {
+				t.Fatalf("Expect %v, Actual %v", expectedPinged, f.pinged)
+			}
+
+			expectedReplacements := []types.NodeID{}
+			for _, i := range tt.expectedReplacements {
+				expectedReplacements = append(expectedReplacements, bucketContact(i).NodeID)
+			}
+			if !reflect.DeepEqual(expectedReplacements, ids(rt.replacements[0])) {
+				t.Fatalf("Expect %v, Actual %v", expectedReplacements, ids(rt.replacements[0]))
+			}
+		})
+	}
+}
+
+func TestUpdateRejectsInvalidContacts(t *testing.T) {
+	rt := newRoutingTable(types.Contact{NodeID: types.NodeID{1}})
+
+	var testCases = []struct {
+		name string
+		c    types.Contact
+	}{
+		{"current node", types.Contact{NodeID: types.NodeID{1}, IP: "127.0.0.1", Port: "8080"}},
+		{"no address", types.Contact{NodeID: types.NodeID{2}}},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := rt.update(tt.c); err == nil {
+				t.Fatalf("Expect an error, Actual %v", err)
+			}
+			if _, found := rt.find(tt.c.NodeID); found {
+				t.Fatalf("Expect %v, Actual %v", false, found)
+			}
+		})
+	}
+}
+
+func TestReplacementCacheIsBounded(t *testing.T) {
+	f := &fakePinger{dead: map[types.NodeID]bool{}}
+	rt := setupFullBucket(f)
+	for i := b.K; i < 3*b.K; i++ {
+		rt.update(bucketContact(i))
+	}
+
+	// Only the K most recently seen candidates are kept, least recently seen first.
+	cache := rt.replacements[0]
+	if len(cache) != b.K {
+		t.Fatalf("Expect %v, Actual %v", b.K, len(cache))
+	}
+	if cache[0].NodeID != bucketContact(2*b.K).NodeID {
+		t.Fatalf("Expect %v, Actual %v", bucketContact(2*b.K).NodeID, cache[0].NodeID)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	var testCases = []struct {
+		name         string
+		updates      []int
+		remove       int
+		expectedLen  int
+		expectedTail int
+		expectedSize int
+	}{
+		{"most recent replacement takes its place", []int{b.K, b.K + 1}, 3, b.K, b.K + 1, 1},
+		{"without replacements", nil, 3, b.K - 1, b.K - 1, 0},
+		{"replacement removed from the cache", []int{b.K, b.K + 1}, b.K + 1, b.K, 1, 1},
+		{"unknown contact", nil, 2 * b.K, b.K, b.K - 1, 0},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakePinger{dead: map[types.NodeID]bool{}}
+			rt := setupFullBucket(f)
+
+			// The heads are alive, so the new contacts go to the replacement cache
+			// and each pinged head, contact 0 then contact 1, moves to the tail.
+			for _, i := range tt.updates {
+				rt.update(bucketContact(i))
+			}
+			rt.remove(bucketContact(tt.remove))
+
+			bucket := rt.buckets[0]
+			if len(bucket) != tt.expectedLen {
+				t.Fatalf("Expect %v, Actual %v", tt.expectedLen, len(bucket))
+			}
+			tail := bucket[len(bucket)-1].NodeID
+			expectedTail := bucketContact(tt.expectedTail).NodeID
+			if tail != expectedTail {
+				t.Fatalf("Expect %v, Actual %v", expectedTail, tail)
+			}
+			if len(rt.replacements[0]) != tt.expectedSize {
+				t.Fatalf("Expect %v, Actual %v", tt.expectedSize, len(rt.replacements[0]))
+			}
+			if _, found := rt.find(bucketContact(tt.remove).NodeID); found {
+				t.Fatalf("Expect %v, Actual %v", false, found)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+
+	b "github.com/jessicagreben/kademlia/pkg/bucket"
+	"github.com/jessicagreben/kademlia/pkg/types"
+)
+
+// StoreArgs are the arguments to the Store RPC.
+type StoreArgs struct {
+	RequestFrom types.Contact
+	Key         types.NodeID
+	Value       []byte
+}
+
+// StoreResult is the response to the Store RPC.
+type StoreResult struct {
+	Success bool
+	ErrMsg  string
+}
+
+// Store keeps the value at the key in the local store of the node.
+func (n *Network) Store(a StoreArgs, reply *StoreResult) error {
+	n.values.Put(a.Key, a.Value)
+	reply.Success = true
+
+	// Update Contact of the node making the request to the route table.
+	n.rt.update(a.RequestFrom)
+	return nil
+}
+
+// FindValueArgs are the arguments to the FindValue RPC.
+type FindValueArgs struct {
+	RequestFrom types.Contact
+	Key         types.NodeID
+}
+
+// FindValueResult is the response to the FindValue RPC. From is the contact of
+// the node replying. Value is set when Found, otherwise Contacts are the closest
+// nodes to the key.
+type FindValueResult struct {
+	Success  bool
+	Found    bool
+	From     types.Contact
+	Value    []byte
+	Contacts []types.Contact
+	ErrMsg   string
+}
+
+// FindValue returns the value stored at the key if the node has it.
+// Otherwise, it returns the closest nodes to the key.
+func (n *Network) FindValue(a FindValueArgs, reply *FindValueResult) error {
+	reply.From = n.rt.currentNode
+	value, found := n.values.Get(a.Key)
+	if found {
+		reply.Value = value
+	} else {
+		reply.Contacts = n.closestContacts(a.Key)
+	}
+	reply.Success = true
+	reply.Found = found
+
+	// Update Contact of the node making the request to the route table.
+	n.rt.update(a.RequestFrom)
+	return nil
+}
+
+// PutArgs are the arguments to the Put RPC.
+type PutArgs struct {
+	Key   types.NodeID
+	Value []byte
+}
+
+// PutResult is the response to the Put RPC.
+// Stored is how many nodes of the network, this node included, stored the value.
+type PutResult struct {
+	Success bool
+	Stored  int
+	ErrMsg  string
+}
+
+// Put stores the value at the key in the network. The node keeps the value,
+// looks for the K closest nodes to the key and sends them a Store RPC.
+func (n *Network) Put(a PutArgs, reply *PutResult) error {
+	n.values.Put(a.Key, a.Value)
+	reply.Stored = 1
+
+	for _, c := range n.iterativeFindNode(a.Key, n.closestContacts(a.Key)) {
+		if err := storeValue(a.Key, a.Value, c, n.rt.currentNode); err != nil {
+			continue
+		}
+		reply.Stored++
+	}
+	reply.Success = true
+	return nil
+}
+
+// GetArgs are the arguments to the Get RPC.
+type GetArgs struct {
+	Key types.NodeID
+}
+
+// GetResult is the response to the Get RPC.
+type GetResult struct {
+	Success bool
+	Found   bool
+	Value   []byte
+	ErrMsg  string
+}
+
+// Get looks for the value stored at the key in the network. The node checks its
+// own store first, then sends FindValue RPCs to closer and closer nodes to the
+// key, see iterativeLookup, until one of them has the value.
+func (n *Network) Get(a GetArgs, reply *GetResult) error {
+	reply.Success = true
+	if value, found := n.values.Get(a.Key); found {
+		reply.Value = value
+		reply.Found = true
+		return nil
+	}
+
+	reply.Value, reply.Found = n.iterativeFindValue(a.Key, n.closestContacts(a.Key))
+	return nil
+}
+
+// closestContacts returns the K closest contacts to the key in the routing table.
+func (n *Network) closestContacts(key types.NodeID) []types.Contact {
+	return n.rt.findClosestNodes(key, b.K)
+}
+
+func storeValue(key types.NodeID, value []byte, otherNode types.Contact, currentNode types.Contact) error {
+	addr := fmt.Sprintf("%s:%s", otherNode.IP, otherNode.Port)
+	client, err := client(addr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	r := StoreResult{}
+	args := StoreArgs{
+		RequestFrom: currentNode,
+		Key:         key,
+		Value:       value,
+	}
+	if err := client.Call("Network.Store", args, &r); err != nil {
+		return err
+	}
+	if !r.Success {
+		return errors.New(r.ErrMsg)
+	}
+	return nil
+}
+
+func findValue(key types.NodeID, otherNode types.Contact, currentNode types.Contact) (FindValueResult, error) {
+	addr := fmt.Sprintf("%s:%s", otherNode.IP, otherNode.Port)
+	client, err := client(addr)
+	if err != nil {
+		return FindValueResult{}, err
+	}
+	defer client.Close()
+	r := FindValueResult{}
+	args := FindValueArgs{
+		RequestFrom: currentNode,
+		Key:         key,
+	}
+	if err := client.Call("Network.FindValue", args, &r); err != nil {
+		return FindValueResult{}, err
+	}
+	if !r.Success {
+		return FindValueResult{}, errors.New(r.ErrMsg)
+	}
+	return r, nil
+}
+
+// PutValue asks the node c to store the value at the key in the network.
+// It returns how many nodes stored the value.
+func PutValue(c types.Contact, key types.NodeID, value []byte) (int, error) {
+	addr := fmt.Sprintf("%s:%s", c.IP, c.Port)
+	client, err := client(addr)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+	r := PutResult{}
+	if err := client.Call("Network.Put", PutArgs{Key: key, Value: value}, &r); err != nil {
+		return 0, err
+	}
+	if !r.Success {
+		return 0, errors.New(r.ErrMsg)
+	}
+	return r.Stored, nil
+}
+
+// GetValue asks the node c for the value stored at the key in the network.
+// It returns false if no node has the value.
+func GetValue(c types.Contact, key types.NodeID) ([]byte, bool, error) {
+	addr := fmt.Sprintf("%s:%s", c.IP, c.Port)
+	client, err := client(addr)
+	if err != nil {
+		return nil, false, err
+	}
+	defer client.Close()
+	r := GetResult{}
+	if err := client.Call("Network.Get", GetArgs{Key: key}, &r); err != nil {
+		return nil, false, err
+	}
+	if !r.Success {
+		return nil, false, errors.New(r.ErrMsg)
+	}
+	return r.Value, r.Found, nil
+}
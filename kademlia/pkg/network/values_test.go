@@ -0,0 +1,125 @@
+package network
+
+import (
+	"net"
+	"net/http"
+	"net/rpc"
+	"testing"
+
+	b "github.com/jessicagreben/kademlia/pkg/bucket"
+	"github.com/jessicagreben/kademlia/pkg/node"
+	"github.com/jessicagreben/kademlia/pkg/store"
+	"github.com/jessicagreben/kademlia/pkg/types"
+)
+
+// startNode serves the RPCs of a new node on a local port until the test ends.
+func startNode(t *testing.T, id types.NodeID) *Network {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	n := &Network{
+		rt:     newRoutingTable(types.Contact{NodeID: id, IP: host, Port: port}),
+		values: store.New(),
+	}
+	server := rpc.NewServer()
+	if err := server.Register(n); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, server)
+	go http.Serve(ln, mux)
+	t.Cleanup(func() { ln.Close() })
+	return n
+}
+
+func TestStoreFindValue(t *testing.T) {
+	n := startNode(t, types.NodeID{1})
+	requester := types.Contact{NodeID: types.NodeID{2}, IP: "127.0.0.1", Port: "1"}
+	other := types.Contact{NodeID: types.NodeID{3}, IP: "127.0.0.1", Port: "1"}
+	n.rt.update(other)
+
+	if err := storeValue(types.NodeID{9}, []byte("value"), n.rt.currentNode, requester); err != nil {
+		t.Fatalf("Expect %v, Actual %v", nil, err)
+	}
+
+	var testCases = []struct {
+		name            string
+		key             types.NodeID
+		expectedFound   bool
+		expectedValue   string
+		expectedContact bool
+	}{
+		{"stored", types.NodeID{9}, true, "value", false},
+		{"not stored", types.NodeID{8}, false, "", true},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			actualOut, err := findValue(tt.key, n.rt.currentNode, requester)
+			if err != nil {
+				t.Fatalf("Expect %v, Actual %v", nil, err)
+			}
+			if tt.expectedFound != actualOut.Found {
+				t.Fatalf("Expect %v, Actual %v", tt.expectedFound, actualOut.Found)
+			}
+			if tt.expectedValue != string(actualOut.Value) {
+				t.Fatalf("Expect %q, Actual %q", tt.expectedValue, actualOut.Value)
+			}
+
+			// Without the value, the closest contacts are returned instead.
+			_, _, actualContact := b.Bucket(actualOut.Contacts).Find(other.NodeID)
+			if tt.expectedContact != actualContact {
+				t.Fatalf("Expect %v, Actual %v", tt.expectedContact, actualContact)
+			}
+		})
+	}
+}
+
+func TestPutGetValue(t *testing.T) {
+	// Three nodes that know of each other in a line: first, second, third.
+	first := startNode(t, types.NodeID{0x80})
+	second := startNode(t, types.NodeID{0x40})
+	third := startNode(t, types.NodeID{0x20})
+	first.rt.update(second.rt.currentNode)
+	second.rt.update(first.rt.currentNode)
+	second.rt.update(third.rt.currentNode)
+	third.rt.update(second.rt.currentNode)
+
+	key, _ := node.ParseKey("2000000000000000000000000000000000000001")
+	stored, err := PutValue(second.rt.currentNode, key, []byte("hello"))
+	if err != nil {
+		t.Fatalf("Expect %v, Actual %v", nil, err)
+	}
+	if stored < 2 {
+		t.Fatalf("Expect at least %v, Actual %v", 2, stored)
+	}
+
+	var testCases = []struct {
+		name          string
+		n             *Network
+		key           types.NodeID
+		expectedFound bool
+	}{
+		{"from the node that stored it", second, key, true},
+		{"through another node", first, key, true},
+		{"missing key", first, types.NodeID{7}, false},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			actualOut, actualFound, err := GetValue(tt.n.rt.currentNode, tt.key)
+			if err != nil {
+				t.Fatalf("Expect %v, Actual %v", nil, err)
+			}
+			if tt.expectedFound != actualFound {
+				t.Fatalf("Expect %v, Actual %v", tt.expectedFound, actualFound)
+			}
+			if tt.expectedFound && string(actualOut) != "hello" {
+				t.Fatalf("Expect %q, Actual %q", "hello", actualOut)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package node
 
 import (
 	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 
 	"github.com/jessicagreben/kademlia/pkg/types"
@@ -10,9 +11,11 @@ import (
 const (
 	idLength  = 20 // Length in bytes of the Node ID.
 	keyLength = 20 // Length in bytes of the key for storing data.
-	alpha     = 3  // System wide concurrency parameter.
 )
 
+// Alpha is the system wide concurrency parameter, how many nodes a lookup queries at once.
+const Alpha = 3
+
 // GenerateID does x.
 func GenerateID(idLength int) types.NodeID {
 	id := types.NodeID{}
@@ -27,6 +30,18 @@ func GenerateID(idLength int) types.NodeID {
 	return id
 }
 
+// ParseKey parses a 160-bit key for storing data, written as 40 hex digits.
+func ParseKey(s string) (types.NodeID, error) {
+	key := types.NodeID{}
+	keyBytes, err := hex.DecodeString(s)
+	if err != nil || len(keyBytes) != keyLength {
+		return key, fmt.Errorf("key %q must be %d hex digits", s, keyLength*2)
+	}
+
+	copy(key[:], keyBytes)
+	return key, nil
+}
+
 // Distance is x.
 func Distance(node1, node2 types.NodeID) types.NodeID {
 	xorBytes := types.NodeID{}
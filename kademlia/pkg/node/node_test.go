@@ -78,3 +78,28 @@ func TestFindLongestPrefix(t *testing.T) {
 		})
 	}
 }
+
+func TestParseKey(t *testing.T) {
+	var testCases = []struct {
+		name        string
+		in          string
+		expectedOut types.NodeID
+		expectedErr bool
+	}{
+		{"valid", "ff00000000000000000000000000000000000001", setupNodeID([]byte{255, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}), false},
+		{"too short", "ff", types.NodeID{}, true},
+		{"not hex", "zz00000000000000000000000000000000000001", types.NodeID{}, true},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			actualOut, err := ParseKey(tt.in)
+			if (err != nil) != tt.expectedErr {
+				t.Fatalf("Expected error %v, Actual %v", tt.expectedErr, err)
+			}
+			if actualOut != tt.expectedOut {
+				t.Errorf("Expected %08b, Actual %08b", tt.expectedOut, actualOut)
+			}
+		})
+	}
+}
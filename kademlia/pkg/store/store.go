@@ -0,0 +1,40 @@
+package store
+
+import (
+	"sync"
+
+	"github.com/jessicagreben/kademlia/pkg/types"
+)
+
+// Store is the local store of the values a node keeps for the network.
+// Values are stored at 160-bit keys, in the same space as the node IDs, so the
+// nodes whose IDs are the closest to a key store its value.
+type Store struct {
+	values map[types.NodeID][]byte
+	mu     sync.Mutex
+}
+
+// New creates an empty store.
+func New() *Store {
+	return &Store{
+		values: map[types.NodeID][]byte{},
+	}
+}
+
+// Put stores the value at the key, replacing any previous value.
+func (s *Store) Put(key types.NodeID, value []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Keep a copy so the caller can't change the stored value.
+	s.values[key] = append([]byte{}, value...)
+}
+
+// Get returns the value stored at the key and whether there is one.
+func (s *Store) Get(key types.NodeID) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, found := s.values[key]
+	return value, found
+}
@@ -0,0 +1,50 @@
+package store
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jessicagreben/kademlia/pkg/types"
+)
+
+func TestPutGet(t *testing.T) {
+	s := New()
+	s.Put(types.NodeID{1}, []byte("first"))
+	s.Put(types.NodeID{2}, []byte("second"))
+	s.Put(types.NodeID{2}, []byte("replaced"))
+
+	var testCases = []struct {
+		name          string
+		key           types.NodeID
+		expectedOut   []byte
+		expectedFound bool
+	}{
+		{"stored", types.NodeID{1}, []byte("first"), true},
+		{"replaced", types.NodeID{2}, []byte("replaced"), true},
+		{"missing", types.NodeID{3}, nil, false},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			actualOut, actualFound := s.Get(tt.key)
+			if tt.expectedFound != actualFound {
+				t.Fatalf("Expect %v, Actual %v", tt.expectedFound, actualFound)
+			}
+			if !bytes.Equal(tt.expectedOut, actualOut) {
+				t.Fatalf("Expect %q, Actual %q", tt.expectedOut, actualOut)
+			}
+		})
+	}
+}
+
+func TestPutCopiesValue(t *testing.T) {
+	s := New()
+	value := []byte("value")
+	s.Put(types.NodeID{1}, value)
+	value[0] = 'X'
+
+	actualOut, _ := s.Get(types.NodeID{1})
+	if string(actualOut) != "value" {
+		t.Fatalf("Expect %q, Actual %q", "value", actualOut)
+	}
+}
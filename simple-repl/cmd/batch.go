@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jessicagreben/misc-projects/simple-repl/pkg/storage"
+)
+
+// BatchOptions configures how RunBatch runs a file of commands.
+type BatchOptions struct {
+	// ContinueOnError runs the remaining commands after a command fails,
+	// otherwise the batch stops at the first failed command.
+	ContinueOnError bool
+
+	// JSON writes the result of every command to stdout as one JSON record
+	// per line, instead of writing the output and errors like the REPL.
+	JSON bool
+}
+
+// batchRecord is the result of one command in JSON mode.
+type batchRecord struct {
+	Line    int      `json:"line"`
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	Output  string   `json:"output"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// RunBatch runs the commands in the file at path, or stdin when path is "-", without
+// prompting. Blank lines and lines starting with # are skipped. An error is returned
+// if any command failed. Any transaction still open at the end is discarded.
+func RunBatch(path, dataDir, backend string, opts BatchOptions) error {
+	input := os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	}
+
+	root, err := openRoot(dataDir, backend)
+	if err != nil {
+		return fmt.Errorf("unable to open data directory %s: %v", dataDir, err)
+	}
+	return runBatch(input, os.Stdout, os.Stderr, root, opts)
+}
+
+// runBatch runs the commands read from input on the root store and writes the results.
+func runBatch(input io.Reader, stdout, stderr io.Writer, root storage.Transaction, opts BatchOptions) error {
+	reader := bufio.NewReader(input)
+	encoder := json.NewEncoder(stdout)
+	currentTx := root
+	watched := newWatches()
+	defer func() {
+		storage.ExecuteOp("ABORT", []string{"ALL"}, currentTx)
+		watched.close()
+	}()
+
+	failed := 0
+	for line := 1; ; line++ {
+		text, readErr := reader.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+		if readErr == io.EOF && text == "" {
+			break
+		}
+
+		trimmed := strings.TrimSpace(text)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		cmd, args, err := parseArgs(text)
+		var out string
+		if err == nil && strings.ToUpper(cmd) != "QUIT" {
+			var handled bool
+			if handled, err = watched.execute(cmd, args, currentTx); !handled {
+				currentTx, out, err = storage.ExecuteOp(cmd, args, currentTx)
+			}
+		}
+
+		// The change events of the watched keys committed by the command come first.
+		out = watched.take() + out
+
+		// The newline output after a failed READ only ends the error message.
+		if err != nil && out == "\n" {
+			out = ""
+		}
+
+		if opts.JSON {
+			record := batchRecord{Line: line, Command: cmd, Args: args, Output: strings.TrimSuffix(out, "\n")}
+			if err != nil {
+				record.Error = strings.TrimSuffix(err.Error(), "\n")
+			}
+			if err := encoder.Encode(record); err != nil {
+				return err
+			}
+		} else {
+			if err != nil {
+				fmt.Fprint(stderr, err.Error())
+				if !strings.HasSuffix(err.Error(), "\n") {
+					fmt.Fprintln(stderr)
+				}
+			}
+			fmt.Fprint(stdout, out)
+		}
+
+		if err != nil {
+			failed++
+			if !opts.ContinueOnError {
+				return fmt.Errorf("batch stopped, the command on line %d failed", line)
+			}
+		}
+		if strings.ToUpper(cmd) == "QUIT" {
+			break
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed commands: %d", failed)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/jessicagreben/misc-projects/simple-repl/pkg/storage"
+)
+
+func TestRunBatch(t *testing.T) {
+	script := `# Setup
+WRITE a hello
+
+READ b
+WRITE b "hello world"
+READ b
+QUIT
+WRITE c never
+`
+
+	cases := []struct {
+		name   string
+		opts   BatchOptions
+		stdout string
+		stderr string
+		err    string
+	}{
+		{
+			name:   "stop on error",
+			stdout: "",
+			stderr: "Key not found: b\n",
+			err:    "batch stopped, the command on line 4 failed",
+		},
+		{
+			name:   "continue on error",
+			opts:   BatchOptions{ContinueOnError: true},
+			stdout: "hello world\n",
+			stderr: "Key not found: b\n",
+			err:    "failed commands: 1",
+		},
+		{
+			name: "json",
+			opts: BatchOptions{ContinueOnError: true, JSON: true},
+			stdout: `{"line":2,"command":"WRITE","args":["a","hello"],"output":""}
+{"line":4,"command":"READ","args":["b"],"output":"","error":"Key not found: b"}
+{"line":5,"command":"WRITE","args":["b","hello world"],"output":""}
+{"line":6,"command":"READ","args":["b"],"output":"hello world"}
+{"line":7,"command":"QUIT","args":[],"output":""}
+`,
+			err: "failed commands: 1",
+		},
+	}
+
+	for _, exp := range cases {
+		var stdout, stderr bytes.Buffer
+		root := storage.NewRoot()
+		err := runBatch(strings.NewReader(script), &stdout, &stderr, root, exp.opts)
+
+		// Is the correct output written?
+		if stdout.String() != exp.stdout {
+			t.Fatalf("Failed %s.\nActual: %q.\nExpected: %q.\n", exp.name, stdout.String(), exp.stdout)
+		}
+
+		// Are the correct errors written?
+		if stderr.String() != exp.stderr {
+			t.Fatalf("Failed %s.\nActual: %q.\nExpected: %q.\n", exp.name, stderr.String(), exp.stderr)
+		}
+
+		// Is the batch reported as failed?
+		var actualMsg string
+		if err != nil {
+			actualMsg = err.Error()
+		}
+		if actualMsg != exp.err {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: %v.\n", exp.name, actualMsg, exp.err)
+		}
+
+		// Are the commands after QUIT skipped?
+		if _, _, err := storage.ExecuteOp("READ", []string{"c"}, root); err == nil {
+			t.Fatalf("Failed %s.\nActual: nil.\nExpected: Key not found: c.\n", exp.name)
+		}
+	}
+}
+
+func TestRunBatchDiscardsOpenTransactions(t *testing.T) {
+	root := storage.NewRoot()
+	script := "WRITE a hello\nSTART\nWRITE a pending\nSTART\n"
+	if err := runBatch(strings.NewReader(script), &bytes.Buffer{}, &bytes.Buffer{}, root, BatchOptions{}); err != nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: nil.\n", err)
+	}
+
+	// Is the value committed before the open transactions kept?
+	if _, out, _ := storage.ExecuteOp("READ", []string{"a"}, root); out != "hello\n" {
+		t.Fatalf("Failed.\nActual: %q.\nExpected: %q.\n", out, "hello\n")
+	}
+}
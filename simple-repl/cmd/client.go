@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// Connect starts a REPL that sends the commands to the server at addr
+// and prints the responses, output to stdout and errors to stderr.
+// Change events of watched keys are printed as soon as they arrive.
+func Connect(addr string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stdin := bufio.NewReader(os.Stdin)
+	lines, pipe := io.Pipe()
+	go printEvents(bufio.NewReader(conn), pipe, os.Stdout)
+	responses := bufio.NewReader(lines)
+
+	for {
+		fmt.Print("> ")
+		input, err := stdin.ReadString('\n')
+		if err != nil && input == "" {
+			return nil
+		}
+		if !strings.HasSuffix(input, "\n") {
+			input += "\n"
+		}
+
+		if _, err := io.WriteString(conn, input); err != nil {
+			return err
+		}
+		if err := readResponse(responses, os.Stdout, os.Stderr); err != nil {
+			return err
+		}
+
+		cmd, _, _ := parseArgs(input)
+		if strings.ToUpper(cmd) == "QUIT" {
+			fmt.Fprintf(os.Stderr, "Exiting...\n")
+			return nil
+		}
+	}
+}
+
+// printEvents prints the event lines read from the server to stdout
+// and passes every other line on to the responses pipe.
+func printEvents(conn *bufio.Reader, responses *io.PipeWriter, stdout io.Writer) {
+	for {
+		line, err := conn.ReadString('\n')
+		if err != nil {
+			responses.CloseWithError(err)
+			return
+		}
+		if line[0] == eventMarker {
+			fmt.Fprint(stdout, line[1:])
+			continue
+		}
+		if _, err := io.WriteString(responses, line); err != nil {
+			return
+		}
+	}
+}
+
+// readResponse reads the lines of one response from the server and
+// writes them to stdout or stderr depending on their marker.
+func readResponse(responses *bufio.Reader, stdout, stderr io.Writer) error {
+	for {
+		line, err := responses.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if len(line) == 0 {
+			continue
+		}
+
+		switch line[0] {
+		case outputMarker:
+			fmt.Fprint(stdout, line[1:])
+		case errorMarker:
+			fmt.Fprint(stderr, line[1:])
+		case eventMarker:
+			fmt.Fprint(stdout, line[1:])
+		case endMarker:
+			return nil
+		}
+	}
+}
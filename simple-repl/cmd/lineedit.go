@@ -0,0 +1,445 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jessicagreben/misc-projects/simple-repl/pkg/storage"
+)
+
+const (
+	prompt             = "> "
+	continuationPrompt = "... "
+
+	// historySize is how many of the most recent lines the history file keeps.
+	historySize = 1000
+)
+
+// secretCommands are the commands whose lines carry a secret, e.g a password,
+// so they are never kept in the history.
+var secretCommands = map[string]bool{"AUTH": true}
+
+// Keys the line editor handles.
+const (
+	keyCtrlA     = 1
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyCtrlH     = 8
+	keyTab       = 9
+	keyEnter     = 13
+	keyCtrlU     = 21
+	keyEscape    = 27
+	keyBackspace = 127
+)
+
+// commandNames are the commands completed by the line editor.
+var commandNames = []string{
+	"ABORT", "APPEND", "AUTH", "CAS", "COMMIT", "DECR", "DELETE", "DIFF", "DUMP",
+	"EXISTS", "HISTORY", "INCR", "INCRBY", "KEYS", "LOAD", "PERSIST", "PREFIX",
+	"QUIT", "READ", "RELEASE", "ROLLBACK", "SAVEPOINT", "SCAN", "SNAPSHOT",
+	"START", "STATUS", "TTL", "UNWATCH", "WATCH", "WRITE",
+}
+
+// errInterrupted is returned by the line editor when Ctrl-C discards the input.
+var errInterrupted = errors.New("interrupted")
+
+// lineReader reads the lines of input typed at the prompt, without the newline.
+type lineReader interface {
+	readLine(prompt string) (string, error)
+}
+
+// newLineReader returns a line editor when stdin is a terminal, otherwise a
+// reader that reads stdin like a pipe. The line editor keeps the lines entered
+// in the history file, if any, and completes the words with complete.
+func newLineReader(stdin *os.File, stdout io.Writer, historyPath string, complete func(word string, first bool) []string) lineReader {
+	if !isTerminal(stdin.Fd()) {
+		return &pipeReader{in: bufio.NewReader(stdin), out: stdout}
+	}
+
+	editor := &lineEditor{
+		in:          bufio.NewReader(stdin),
+		out:         stdout,
+		raw:         func() (func(), error) { return makeRaw(stdin.Fd()) },
+		complete:    complete,
+		historyPath: historyPath,
+	}
+	editor.loadHistory()
+	return editor
+}
+
+// readInput reads one command, which continues on the next lines while a quoted
+// string is not terminated, or when the line ends with a backslash. Input
+// discarded with Ctrl-C is an empty command.
+func readInput(lines lineReader) (string, error) {
+	input, err := lines.readLine(prompt)
+	for err == nil {
+		var more bool
+		if input, more = continuation(input); !more {
+			break
+		}
+
+		var next string
+		next, err = lines.readLine(continuationPrompt)
+		input += next
+	}
+	if err == errInterrupted {
+		return "", nil
+	}
+	return input, err
+}
+
+// continuation returns the input to continue with the next line and true if the
+// command continues, i.e a quoted string is not terminated. The newline is kept
+// inside the quoted string. Like in tokenize, a backslash outside of quotes is
+// an ordinary character, even at the end of the line.
+func continuation(input string) (string, bool) {
+	quoted := false
+	for i := 0; i < len(input); i++ {
+		switch input[i] {
+		case '\\':
+			// Only inside quotes does a backslash escape the next character.
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		}
+	}
+	if quoted {
+		return input + "\n", true
+	}
+	return input, false
+}
+
+// pipeReader reads lines from stdin when it's not a terminal, e.g a pipe.
+type pipeReader struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func (p *pipeReader) readLine(prompt string) (string, error) {
+	fmt.Fprint(p.out, prompt)
+	line, err := p.in.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// lineEditor reads lines from a terminal in raw mode. The line can be edited
+// with the arrow keys, Home, End, Backspace, Ctrl-A, Ctrl-E and Ctrl-U, the up
+// and down arrows go through the history and Tab completes the word before the
+// cursor. Ctrl-C discards the line and Ctrl-D on an empty line ends the input.
+type lineEditor struct {
+	in  *bufio.Reader
+	out io.Writer
+
+	// raw puts the terminal in raw mode while a line is read.
+	raw func() (func(), error)
+
+	// complete returns the completions of the word, the first word of the line or not.
+	complete func(word string, first bool) []string
+
+	// history holds the lines entered, oldest first. They're appended to the
+	// history file, if any, so they're kept across sessions. historyLines is
+	// the number of lines in the file.
+	history      []string
+	historyPath  string
+	historyLines int
+
+	line   []rune
+	cursor int
+}
+
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	restore, err := e.raw()
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+
+	e.line, e.cursor = nil, 0
+	position := len(e.history)
+	draft := ""
+	e.refresh(prompt)
+
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch r {
+		case keyEnter, '\n':
+			fmt.Fprint(e.out, "\r\n")
+			line := string(e.line)
+			e.addHistory(line)
+			return line, nil
+		case keyCtrlC:
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case keyCtrlD:
+			if len(e.line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+		case keyBackspace, keyCtrlH:
+			if e.cursor > 0 {
+				e.line = append(e.line[:e.cursor-1], e.line[e.cursor:]...)
+				e.cursor--
+			}
+		case keyCtrlA:
+			e.cursor = 0
+		case keyCtrlE:
+			e.cursor = len(e.line)
+		case keyCtrlU:
+			e.line, e.cursor = e.line[e.cursor:], 0
+		case keyTab:
+			e.completeWord(prompt)
+		case keyEscape:
+			switch e.readEscape() {
+			case "[A", "OA":
+				if position > 0 {
+					if position == len(e.history) {
+						draft = string(e.line)
+					}
+					position--
+					e.setLine(e.history[position])
+				}
+			case "[B", "OB":
+				if position < len(e.history) {
+					position++
+					if position == len(e.history) {
+						e.setLine(draft)
+					} else {
+						e.setLine(e.history[position])
+					}
+				}
+			case "[C", "OC":
+				if e.cursor < len(e.line) {
+					e.cursor++
+				}
+			case "[D", "OD":
+				if e.cursor > 0 {
+					e.cursor--
+				}
+			case "[H", "OH", "[1~":
+				e.cursor = 0
+			case "[F", "OF", "[4~":
+				e.cursor = len(e.line)
+			case "[3~":
+				if e.cursor < len(e.line) {
+					e.line = append(e.line[:e.cursor], e.line[e.cursor+1:]...)
+				}
+			}
+		default:
+			if unicode.IsPrint(r) {
+				e.insert(string(r))
+			}
+		}
+		e.refresh(prompt)
+	}
+}
+
+// readEscape reads the rest of an escape sequence, e.g "[A" for the up arrow.
+func (e *lineEditor) readEscape() string {
+	kind, _, err := e.in.ReadRune()
+	if err != nil || (kind != '[' && kind != 'O') {
+		return ""
+	}
+
+	sequence := []rune{kind}
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return ""
+		}
+		sequence = append(sequence, r)
+
+		// The sequence ends with a letter or a tilde.
+		if r >= 0x40 && r <= 0x7e {
+			return string(sequence)
+		}
+	}
+}
+
+// insert inserts the text at the cursor and moves the cursor after it.
+func (e *lineEditor) insert(text string) {
+	runes := []rune(text)
+	line := append([]rune{}, e.line[:e.cursor]...)
+	line = append(line, runes...)
+	e.line = append(line, e.line[e.cursor:]...)
+	e.cursor += len(runes)
+}
+
+// setLine replaces the line and moves the cursor to its end.
+func (e *lineEditor) setLine(line string) {
+	e.line = []rune(line)
+	e.cursor = len(e.line)
+}
+
+// refresh redraws the prompt and the line and puts the cursor in place.
+func (e *lineEditor) refresh(prompt string) {
+	fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(e.line))
+	if back := len(e.line) - e.cursor; back > 0 {
+		fmt.Fprintf(e.out, "\x1b[%dD", back)
+	}
+}
+
+// completeWord completes the word before the cursor. A single completion is
+// inserted, quoted if needed, followed by a space. With more than one, their
+// common prefix is inserted or, if there is none longer than the word or it
+// needs quoting, they are listed.
+func (e *lineEditor) completeWord(prompt string) {
+	if e.complete == nil {
+		return
+	}
+
+	before := string(e.line[:e.cursor])
+	start := strings.LastIndexAny(before, " \t") + 1
+	word := before[start:]
+	first := strings.TrimSpace(before[:start]) == ""
+
+	completions := e.complete(word, first)
+	switch {
+	case len(completions) == 0:
+		return
+	case len(completions) == 1:
+		e.replaceWord(len([]rune(word)), storage.QuoteArg(completions[0])+" ")
+		return
+	}
+
+	if common := commonPrefix(completions); len(common) > len(word) && storage.QuoteArg(common) == common {
+		e.replaceWord(len([]rune(word)), common)
+		return
+	}
+	fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(completions, "  "))
+}
+
+// replaceWord replaces the n runes before the cursor with the text.
+func (e *lineEditor) replaceWord(n int, text string) {
+	e.line = append(e.line[:e.cursor-n], e.line[e.cursor:]...)
+	e.cursor -= n
+	e.insert(text)
+}
+
+// commonPrefix returns the longest prefix of all the words, made of whole runes.
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, word := range words[1:] {
+		for !strings.HasPrefix(word, prefix) {
+			_, size := utf8.DecodeLastRuneInString(prefix)
+			prefix = prefix[:len(prefix)-size]
+		}
+	}
+	return prefix
+}
+
+// loadHistory reads the most recent lines of the history file, if it exists.
+// The file is rewritten if it holds more lines than that, or secrets.
+func (e *lineEditor) loadHistory() {
+	if e.historyPath == "" {
+		return
+	}
+	data, err := os.ReadFile(e.historyPath)
+	if err != nil {
+		return
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		e.historyLines++
+		if !secretLine(line) {
+			e.history = append(e.history, line)
+		}
+	}
+	if len(e.history) > historySize {
+		e.history = e.history[len(e.history)-historySize:]
+	}
+	if e.historyLines > len(e.history) {
+		e.saveHistory()
+	}
+}
+
+// addHistory adds the line to the history and appends it to the history file,
+// which is trimmed to the most recent lines once it's full. A line is not added
+// again right after itself, and a line that carries a secret is never added.
+func (e *lineEditor) addHistory(line string) {
+	if strings.TrimSpace(line) == "" || secretLine(line) || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > historySize {
+		e.history = e.history[len(e.history)-historySize:]
+	}
+
+	if e.historyPath == "" {
+		return
+	}
+	if e.historyLines >= historySize {
+		e.saveHistory()
+		return
+	}
+	file, err := os.OpenFile(e.historyPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	if _, err := fmt.Fprintln(file, line); err == nil {
+		e.historyLines++
+	}
+}
+
+// saveHistory replaces the history file with the lines of the history.
+func (e *lineEditor) saveHistory() {
+	tmpPath := e.historyPath + ".tmp"
+	data := strings.Join(e.history, "\n") + "\n"
+	if err := os.WriteFile(tmpPath, []byte(data), 0600); err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+	if err := os.Rename(tmpPath, e.historyPath); err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+	e.historyLines = len(e.history)
+}
+
+// secretLine tells if the line is a command that carries a secret.
+func secretLine(line string) bool {
+	fields := strings.Fields(line)
+	return len(fields) > 0 && secretCommands[strings.ToUpper(fields[0])]
+}
+
+// DefaultHistoryFile returns the history file in the home directory, or
+// no file if the home directory is unknown.
+func DefaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".simple-repl-history")
+}
+
+// completeCommand returns the command names starting with the word, in any case.
+func completeCommand(word string) []string {
+	completions := []string{}
+	for _, name := range commandNames {
+		if strings.HasPrefix(name, strings.ToUpper(word)) {
+			completions = append(completions, name)
+		}
+	}
+	sort.Strings(completions)
+	return completions
+}
@@ -0,0 +1,202 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jessicagreben/misc-projects/simple-repl/pkg/storage"
+)
+
+// newTestEditor returns a line editor reading the keys typed, without a terminal.
+func newTestEditor(keys, historyPath string, complete func(word string, first bool) []string) *lineEditor {
+	editor := &lineEditor{
+		in:          bufio.NewReader(strings.NewReader(keys)),
+		out:         io.Discard,
+		raw:         func() (func(), error) { return func() {}, nil },
+		complete:    complete,
+		historyPath: historyPath,
+	}
+	editor.loadHistory()
+	return editor
+}
+
+// readLines returns the commands read until the end of the input.
+func readLines(lines lineReader) []string {
+	commands := []string{}
+	for {
+		input, err := readInput(lines)
+		if err != nil {
+			return commands
+		}
+		commands = append(commands, input)
+	}
+}
+
+func TestLineEditor(t *testing.T) {
+	// Case setup: keys for the completion.
+	currentTx := storage.NewRoot()
+	for _, key := range []string{"user:alice", "user:bob", "session", "ké1", "kè2", "my key"} {
+		currentTx, _, _ = storage.ExecuteOp("WRITE", []string{key, "x"}, currentTx)
+	}
+	complete := func(word string, first bool) []string {
+		if first {
+			return completeCommand(word)
+		}
+		return storage.Keys(word, currentTx)
+	}
+
+	cases := []struct {
+		name     string
+		keys     string
+		commands []string
+	}{
+		{
+			name:     "typing",
+			keys:     "READ a\rREAD b\n",
+			commands: []string{"READ a", "READ b"},
+		},
+		{
+			name:     "editing with the arrows, backspace and delete",
+			keys:     "READ ab\x1b[D\x7fx\x1b[C\x1b[Hy\x1b[3~\r",
+			commands: []string{"yEAD xb"},
+		},
+		{
+			name:     "home, end and clearing",
+			keys:     "EAD a\x01R\x05b\rjunk\x15READ c\r",
+			commands: []string{"READ ab", "READ c"},
+		},
+		{
+			name:     "history",
+			keys:     "READ a\rREAD b\r\x1b[A\x1b[A\r\x1b[A\x1b[A\x1b[B\r",
+			commands: []string{"READ a", "READ b", "READ a", "READ a"},
+		},
+		{
+			name:     "history keeps the line being typed",
+			keys:     "READ a\rREAD\x1b[A\x1b[B c\r",
+			commands: []string{"READ a", "READ c"},
+		},
+		{
+			name:     "ctrl-c discards the command",
+			keys:     "READ a\x03WRITE \"a\r\x03READ b\r",
+			commands: []string{"", "", "READ b"},
+		},
+		{
+			name:     "ctrl-d on an empty line ends the input",
+			keys:     "READ a\x04\r\x04READ b\r",
+			commands: []string{"READ a"},
+		},
+		{
+			name:     "completing a command",
+			keys:     "wr\t\r",
+			commands: []string{"WRITE "},
+		},
+		{
+			name:     "completing a key",
+			keys:     "READ u\tb\t\rREAD s\t\rREAD x\t\r",
+			commands: []string{"READ user:bob ", "READ session ", "READ x"},
+		},
+		{
+			name:     "completing a key that needs quoting",
+			keys:     "READ m\t\r",
+			commands: []string{`READ "my key" `},
+		},
+		{
+			name:     "completing keys that share the first byte of a rune",
+			keys:     "READ k\t\r",
+			commands: []string{"READ k"},
+		},
+		{
+			name:     "completing with many matches",
+			keys:     "S\t\r",
+			commands: []string{"S"},
+		},
+		{
+			name:     "multi-line input",
+			keys:     "WRITE a \"hello\rworld\"\rWRITE path C:\\\rREAD path\r",
+			commands: []string{"WRITE a \"hello\nworld\"", "WRITE path C:\\", "READ path"},
+		},
+		{
+			name:     "quote after a backslash outside of quotes",
+			keys:     "WRITE c C:\\\"x\ry\"\r",
+			commands: []string{"WRITE c C:\\\"x\ny\""},
+		},
+	}
+
+	for _, exp := range cases {
+		actual := readLines(newTestEditor(exp.keys, "", complete))
+
+		// Are the commands read correctly?
+		if !reflect.DeepEqual(actual, exp.commands) {
+			t.Fatalf("Failed %s.\nActual: %q.\nExpected: %q.\n", exp.name, actual, exp.commands)
+		}
+	}
+}
+
+func TestLineEditorHistoryFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+
+	// Case setup: a session that enters two commands, one of them twice.
+	readLines(newTestEditor("READ a\rREAD a\r \rWRITE b 1\r", path, nil))
+
+	// Is the history kept in the file?
+	data, _ := os.ReadFile(path)
+	expected := "READ a\nWRITE b 1\n"
+	if string(data) != expected {
+		t.Fatalf("Failed.\nActual: %q.\nExpected: %q.\n", data, expected)
+	}
+
+	// Does the next session go through the history of the previous one?
+	actual := readLines(newTestEditor("\x1b[A\x1b[A\r", path, nil))
+	if !reflect.DeepEqual(actual, []string{"READ a"}) {
+		t.Fatalf("Failed.\nActual: %q.\nExpected: %q.\n", actual, []string{"READ a"})
+	}
+}
+
+func TestLineEditorHistorySecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+
+	// Case setup: a full history file, with a secret saved before secrets were left out.
+	var lines strings.Builder
+	for i := 0; i < historySize+10; i++ {
+		fmt.Fprintf(&lines, "READ %d\n", i)
+	}
+	lines.WriteString("AUTH bob secret\n")
+	os.WriteFile(path, []byte(lines.String()), 0600)
+
+	// Are the lines that carry a secret left out of the history?
+	editor := newTestEditor("auth token\rREAD a\r", path, nil)
+	readLines(editor)
+	data, _ := os.ReadFile(path)
+	if strings.Contains(strings.ToUpper(string(data)), "AUTH") {
+		t.Fatalf("Failed.\nActual: %q.\nExpected: no AUTH line.\n", data[len(data)-40:])
+	}
+
+	// Is the file trimmed to the most recent lines?
+	saved := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(saved) != historySize || saved[len(saved)-1] != "READ a" || saved[0] != "READ 11" {
+		t.Fatalf("Failed.\nActual: %d lines from %q to %q.\nExpected: %d lines from %q to %q.\n", len(saved), saved[0], saved[len(saved)-1], historySize, "READ 11", "READ a")
+	}
+}
+
+func TestPipeReader(t *testing.T) {
+	var output strings.Builder
+	lines := &pipeReader{in: bufio.NewReader(strings.NewReader("READ a\r\nWRITE a \"x\ny\"\nREAD a")), out: &output}
+
+	// Are the lines of the pipe read as commands, with multi-line input?
+	actual := readLines(lines)
+	expected := []string{"READ a", "WRITE a \"x\ny\"", "READ a"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Failed.\nActual: %q.\nExpected: %q.\n", actual, expected)
+	}
+
+	// Are the prompts written?
+	if output.String() != "> > ... > > " {
+		t.Fatalf("Failed.\nActual: %q.\nExpected: %q.\n", output.String(), "> > ... > > ")
+	}
+}
@@ -1,52 +1,115 @@
 package cmd
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"strings"
+	"sync"
 
 	"github.com/jessicagreben/misc-projects/simple-repl/pkg/storage"
 )
 
 // Run starts the REPL, reading from stdin and executing the commands.
-func Run() {
-	root := storage.Transaction{
-		Operations: map[string]string{},
+// When dataDir is set, committed operations are persisted to dataDir and
+// recovered on startup, see openRoot. Otherwise the store is in-memory only.
+// When stdin is a terminal the commands are typed in a line editor that keeps
+// the lines entered in historyPath, if set, see lineEditor.
+func Run(dataDir, backend, historyPath string) {
+	root, err := openRoot(dataDir, backend)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: unable to open data directory %s: %v\n", dataDir, err)
+		os.Exit(1)
 	}
 	currentTx := root
 
+	// mu serializes the commands with the background sweep of expired keys.
+	var mu sync.Mutex
+	go sweep(root, &mu)
+	watched := newWatches()
+
+	// Complete the command names, then the keys visible to the current transaction.
+	complete := func(word string, first bool) []string {
+		if first {
+			return completeCommand(word)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return storage.Keys(word, currentTx)
+	}
+	lines := newLineReader(os.Stdin, os.Stdout, historyPath, complete)
+
 	for {
-		var cmd, key, value, out string
+		var cmd, out string
+		var args []string
 		var err error
 
-		var reader = bufio.NewReader(os.Stdin)
-		fmt.Print("> ")
-		input, _ := reader.ReadString('\n')
+		// Stop at the end of the input, e.g when stdin is a pipe or on Ctrl-D.
+		input, readErr := readInput(lines)
+		if readErr != nil {
+			if readErr != io.EOF {
+				fmt.Fprintf(os.Stderr, "ERROR: reading the input failed: %v\n", readErr)
+			}
+			fmt.Println()
+			return
+		}
 
-		cmd, key, value = parseArgs(input)
+		cmd, args, err = parseArgs(input)
+		if err != nil {
+			fmt.Fprint(os.Stderr, err)
+			continue
+		}
 
-		currentTx, out, err = storage.ExecuteOp(cmd, key, value, currentTx)
+		mu.Lock()
+		if handled, watchErr := watched.execute(cmd, args, currentTx); handled {
+			err = watchErr
+		} else {
+			currentTx, out, err = storage.ExecuteOp(cmd, args, currentTx)
+		}
+		mu.Unlock()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, err.Error())
+			fmt.Fprint(os.Stderr, err)
 		}
 
+		// Print the change events of the watched keys committed by the command.
+		fmt.Print(watched.take())
 		fmt.Print(out)
 	}
 }
 
-// parseArgs parses the input from the REPL.
-func parseArgs(input string) (cmd string, key string, value string) {
-	args := strings.Split(strings.Trim(input, "\n "), " ")
-
-	switch len(args) {
-	case 3:
-		cmd, key, value = args[0], args[1], args[2]
-	case 2:
-		cmd, key = args[0], args[1]
-	case 1:
-		cmd = args[0]
+// openRoot returns the root transaction of the store. When dataDir is set the
+// root transaction is recovered from, and persisted to, the data directory by
+// the backend: "memory" keeps the store in memory backed by a write-ahead log
+// and snapshots, "lsm" keeps the store on disk as a log-structured merge tree.
+func openRoot(dataDir, backend string) (storage.Transaction, error) {
+	switch backend {
+	case "memory":
+		if dataDir == "" {
+			return storage.NewRoot(), nil
+		}
+		return storage.Open(dataDir)
+	case "lsm":
+		if dataDir == "" {
+			return storage.Transaction{}, errors.New("the lsm backend needs a data directory")
+		}
+		store, err := storage.OpenLSMStore(dataDir)
+		if err != nil {
+			return storage.Transaction{}, err
+		}
+		return storage.NewRootWith(store), nil
 	}
+	return storage.Transaction{}, fmt.Errorf("unknown backend %s", backend)
+}
 
-	return cmd, key, value
+// parseArgs parses the input from the REPL into the command and its arguments.
+// See tokenize for the syntax of the arguments.
+func parseArgs(input string) (cmd string, args []string, err error) {
+	tokens, err := tokenize(input)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(tokens) == 0 {
+		return "", []string{}, nil
+	}
+	return tokens[0], tokens[1:], nil
 }
@@ -1,64 +1,125 @@
 package cmd
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 func TestParseArgs(t *testing.T) {
 	cases := []struct {
-		args  string
-		cmd   string
-		key   string
-		value string
+		args    string
+		cmd     string
+		cmdArgs []string
+		err     string
 	}{
 		{
-			"",
-			"",
-			"",
-			"",
+			args:    "",
+			cmd:     "",
+			cmdArgs: []string{},
 		},
 		{
-			" WRITE a hello\n",
-			"WRITE",
-			"a",
-			"hello",
+			args:    " WRITE a hello\n",
+			cmd:     "WRITE",
+			cmdArgs: []string{"a", "hello"},
 		},
 		{
-			"QUIT\n",
-			"QUIT",
-			"",
-			"",
+			args:    "QUIT\n",
+			cmd:     "QUIT",
+			cmdArgs: []string{},
 		},
 		{
-			"READ a \n",
-			"READ",
-			"a",
-			"",
+			args:    "READ a \n",
+			cmd:     "READ",
+			cmdArgs: []string{"a"},
+		},
+		{
+			args:    "CAS a hello hello-again\n",
+			cmd:     "CAS",
+			cmdArgs: []string{"a", "hello", "hello-again"},
+		},
+		{
+			args:    "WRITE\ta   \"hello world\"\r\n",
+			cmd:     "WRITE",
+			cmdArgs: []string{"a", "hello world"},
+		},
+		{
+			args:    `WRITE "a key" "" say" \"hi\""` + "\n",
+			cmd:     "WRITE",
+			cmdArgs: []string{"a key", "", `say "hi"`},
+		},
+		{
+			args:    `WRITE a "line\none\ttab\\\0\x7f"`,
+			cmd:     "WRITE",
+			cmdArgs: []string{"a", "line\none\ttab\\\x00\x7f"},
+		},
+		{
+			args:    `WRITE C:\dir hello\ world \x4`,
+			cmd:     "WRITE",
+			cmdArgs: []string{`C:\dir`, `hello\`, "world", `\x4`},
+		},
+		{
+			args:    `WRITE a x"68690aff" b"0110100001101001" X"" B"01000001"x "x" 0x6869 0b01000001 ax"41"`,
+			cmd:     "WRITE",
+			cmdArgs: []string{"a", "hi\n\xff", "hi", "", "Ax", "x", "0x6869", "0b01000001", "ax41"},
+		},
+		{
+			args: `WRITE a x"686"`,
+			err:  "ERROR: syntax error at column 9: a hex literal must hold an even number of hex digits.\n",
+		},
+		{
+			args: `WRITE a b"0110"`,
+			err:  "ERROR: syntax error at column 9: a binary literal must hold groups of 8 binary digits.\n",
+		},
+		{
+			args: `WRITE a x"zz`,
+			err:  "ERROR: syntax error at column 10: unterminated quoted string.\n",
+		},
+		{
+			args: "WRITE \"snowman ☃\" x\"y",
+			err:  "ERROR: syntax error at column 20: unterminated quoted string.\n",
+		},
+		{
+			args: `WRITE a "hello\q"`,
+			err:  "ERROR: syntax error at column 15: unknown escape sequence \\q.\n",
+		},
+		{
+			args: `WRITE a "\x4"`,
+			err:  "ERROR: syntax error at column 10: \\x must be followed by two hex digits.\n",
+		},
+		{
+			args: "WRITE a \"hello\\\n",
+			err:  "ERROR: syntax error at column 15: incomplete escape sequence.\n",
 		},
 	}
 
 	for _, exp := range cases {
-		cmd, key, value := parseArgs(exp.args)
+		cmd, cmdArgs, err := parseArgs(exp.args)
 
-		// Is the correct command parsed from the input?
-		if cmd != exp.cmd {
+		// Is the correct syntax error returned?
+		var actualMsg string
+		if err != nil {
+			actualMsg = err.Error()
+		}
+		if actualMsg != exp.err {
 			t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n",
-				cmd,
-				exp.cmd,
+				actualMsg,
+				exp.err,
 			)
 		}
 
-		// Is the correct key parsed from the input?
-		if key != exp.key {
+		// Is the correct command parsed from the input?
+		if cmd != exp.cmd {
 			t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n",
-				key,
-				exp.key,
+				cmd,
+				exp.cmd,
 			)
 		}
 
-		// Is the correct value parsed from the input?
-		if value != exp.value {
-			t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n",
-				value,
-				exp.value,
+		// Are the correct arguments parsed from the input?
+		if err == nil && !reflect.DeepEqual(cmdArgs, exp.cmdArgs) {
+			t.Fatalf("Failed.\nActual: %q.\nExpected: %q.\n",
+				cmdArgs,
+				exp.cmdArgs,
 			)
 		}
 	}
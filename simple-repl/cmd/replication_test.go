@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// TestHelperServer is not a test, it runs a server in a child process
+// started by startServerProcess.
+func TestHelperServer(t *testing.T) {
+	if os.Getenv("REPL_HELPER_SERVER") != "1" {
+		return
+	}
+	err := Serve(os.Getenv("REPL_HELPER_ADDR"), os.Getenv("REPL_HELPER_DATA"), "memory", ServerOptions{Primary: os.Getenv("REPL_HELPER_PRIMARY")})
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// startServerProcess runs a durable server in a child process, a replica when primary is set.
+func startServerProcess(t *testing.T, addr, dataDir, primary string) *exec.Cmd {
+	process := exec.Command(os.Args[0], "-test.run=^TestHelperServer$")
+	process.Env = append(os.Environ(),
+		"REPL_HELPER_SERVER=1",
+		"REPL_HELPER_ADDR="+addr,
+		"REPL_HELPER_DATA="+dataDir,
+		"REPL_HELPER_PRIMARY="+primary,
+	)
+	if err := process.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stopServerProcess(process) })
+	return process
+}
+
+// stopServerProcess kills the server, like a crash.
+func stopServerProcess(process *exec.Cmd) {
+	if process.ProcessState == nil {
+		process.Process.Kill()
+		process.Wait()
+	}
+}
+
+// freeAddr returns a local address no server listens on.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// eventually sends the command to the server until it prints the expected
+// output, connecting again while the server is not listening yet.
+func eventually(t *testing.T, addr, input, stdout string) {
+	deadline := time.Now().Add(10 * time.Second)
+	var actual string
+	for time.Now().Before(deadline) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			client := &testClient{conn: conn, responses: bufio.NewReader(conn)}
+			actual, _ = client.do(t, input)
+			conn.Close()
+			if actual == stdout {
+				return
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("Failed %s on %s.\nActual: %q.\nExpected: %q.\n", input, addr, actual, stdout)
+}
+
+func TestReplicaConvergesAfterRestarts(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts server processes")
+	}
+	primaryAddr, replicaAddr := freeAddr(t), freeAddr(t)
+	primaryDir, replicaDir := t.TempDir(), t.TempDir()
+
+	// Case 1 setup: a primary with committed keys and a new replica.
+	primary := startServerProcess(t, primaryAddr, primaryDir, "")
+	eventually(t, primaryAddr, "WRITE a 1", "")
+	eventually(t, primaryAddr, "WRITE b 2", "")
+	eventually(t, primaryAddr, "DELETE b", "")
+	replica := startServerProcess(t, replicaAddr, replicaDir, primaryAddr)
+
+	// Does the replica catch up with the primary?
+	eventually(t, replicaAddr, "READ a", "1\n")
+	eventually(t, replicaAddr, "EXISTS b", "deleted\n")
+
+	// Does the replica refuse writes?
+	client := dialTestClient(t, replicaAddr)
+	if _, stderr := client.do(t, "WRITE a 2"); stderr != "ERROR: WRITE called on a read-only replica.\n" {
+		t.Fatalf("Failed.\nActual: %q.\nExpected: %q.\n", stderr, "ERROR: WRITE called on a read-only replica.\n")
+	}
+	client.conn.Close()
+
+	// Case 2 setup: commits made while the replica is down.
+	stopServerProcess(replica)
+	eventually(t, primaryAddr, "WRITE c 3", "")
+	replica = startServerProcess(t, replicaAddr, replicaDir, primaryAddr)
+
+	// Does the restarted replica catch up with the primary?
+	eventually(t, replicaAddr, "READ c", "3\n")
+
+	// Case 3 setup: the primary restarts from its data directory.
+	stopServerProcess(primary)
+	eventually(t, replicaAddr, "READ a", "1\n")
+	startServerProcess(t, primaryAddr, primaryDir, "")
+	eventually(t, primaryAddr, "WRITE d 4", "")
+
+	// Does the replica reconnect to the restarted primary?
+	eventually(t, replicaAddr, "READ d", "4\n")
+	eventually(t, replicaAddr, "KEYS", "a\nc\nd\n")
+
+	// Case 4 setup: the replica is promoted.
+	eventually(t, replicaAddr, "PROMOTE", "")
+	eventually(t, replicaAddr, "WRITE e 5", "")
+
+	// Does the promoted replica accept writes and stop following the primary?
+	eventually(t, replicaAddr, "READ e", "5\n")
+	eventually(t, primaryAddr, "WRITE f 6", "")
+	time.Sleep(100 * time.Millisecond)
+	eventually(t, replicaAddr, "EXISTS f", "never set\n")
+}
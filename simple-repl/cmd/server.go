@@ -0,0 +1,398 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jessicagreben/misc-projects/simple-repl/pkg/storage"
+)
+
+// Every line the server sends starts with a marker so the client can tell
+// output, errors and the end of a response apart.
+const (
+	outputMarker = '+' // The line is output of the command.
+	errorMarker  = '-' // The line is an error of the command.
+	endMarker    = '.' // The response to the command is complete.
+	eventMarker  = '!' // The line is a change event of a watched key, sent at any time.
+)
+
+// replicaRetry is how long a replica waits before reconnecting to its primary.
+var replicaRetry = time.Second
+
+// readCommands are the commands a read-only replica executes.
+var readCommands = map[string]bool{
+	"READ": true, "EXISTS": true, "SCAN": true, "PREFIX": true, "KEYS": true,
+	"TTL": true, "STATUS": true, "HISTORY": true, "DUMP": true, "AUTH": true,
+}
+
+// ServerOptions configures the sessions and the replication of a server.
+type ServerOptions struct {
+	// Accounts is the path of a file of user accounts, see storage.LoadAccounts.
+	// Each session must then authenticate with AUTH and is limited to the
+	// permissions of its user. Without it every session can access every key.
+	Accounts string
+
+	// Primary is the address of the server to replicate. When it's set the
+	// server is a read-only replica of the primary. PrimaryToken is the token
+	// the replica authenticates with if the primary has user accounts.
+	Primary      string
+	PrimaryToken string
+
+	// DumpDir is the directory the files of DUMP and LOAD are in. The clients
+	// name the files relative to it. Without it DUMP and LOAD are disabled, so
+	// clients can't read or write any file of the server.
+	DumpDir string
+}
+
+// server shares one root store between all client sessions.
+type server struct {
+	root storage.Transaction
+
+	// mu serializes the operations of the sessions on the shared root store.
+	mu sync.Mutex
+
+	// accounts are the users the sessions authenticate as, if any.
+	accounts *storage.Accounts
+
+	// primary is the address of the server a replica follows, it's empty on a
+	// primary or a promoted replica. follow is the connection to the primary.
+	primary string
+	follow  net.Conn
+
+	// dumpDir is the directory of the files of DUMP and LOAD, see ServerOptions.
+	dumpDir string
+}
+
+// Serve starts a TCP server on addr. Each client connection is a session with its
+// own transaction stack over the shared root store, speaking the REPL commands.
+//
+// When opts.Primary is set, the server is a read-only replica of the server at
+// that address: the commits made on the primary are streamed to the replica and
+// applied in order, reconnecting whenever the connection fails, until a client
+// sends PROMOTE.
+func Serve(addr, dataDir, backend string, opts ServerOptions) error {
+	root, err := openRoot(dataDir, backend)
+	if err != nil {
+		return err
+	}
+
+	var accounts *storage.Accounts
+	if opts.Accounts != "" {
+		if accounts, err = storage.LoadAccounts(opts.Accounts); err != nil {
+			return err
+		}
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	log.Printf("Listening on %s", ln.Addr())
+
+	s := &server{root: root, accounts: accounts, primary: opts.Primary, dumpDir: opts.DumpDir}
+	go sweep(s.root, &s.mu)
+	if opts.Primary != "" {
+		go s.replicate(opts.Primary, opts.PrimaryToken)
+	}
+	return s.serve(ln)
+}
+
+// replicate follows the primary until the server is promoted.
+func (s *server) replicate(primary, token string) {
+	for {
+		err := s.followPrimary(primary, token)
+
+		s.mu.Lock()
+		promoted := s.primary == ""
+		s.mu.Unlock()
+		if promoted {
+			return
+		}
+		log.Printf("Replication from %s failed, retrying: %v", primary, err)
+		time.Sleep(replicaRetry)
+	}
+}
+
+// followPrimary asks the primary for its replication stream, authenticated
+// with the token if any, and applies it.
+func (s *server) followPrimary(primary, token string) error {
+	conn, err := net.Dial("tcp", primary)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	s.mu.Lock()
+	if s.primary == "" {
+		s.mu.Unlock()
+		return nil
+	}
+	s.follow = conn
+	s.mu.Unlock()
+
+	reader := bufio.NewReader(conn)
+	if token != "" {
+		fmt.Fprintf(conn, "AUTH %s\n", token)
+		var stderr strings.Builder
+		if err := readResponse(reader, io.Discard, &stderr); err != nil {
+			return err
+		}
+		if stderr.Len() > 0 {
+			return errors.New(strings.TrimSpace(stderr.String()))
+		}
+	}
+	if _, err := fmt.Fprintln(conn, "REPLICATE"); err != nil {
+		return err
+	}
+	return storage.Follow(reader, s.root, &s.mu)
+}
+
+// promote makes the replica a primary that accepts writes.
+func (s *server) promote() error {
+	if s.primary == "" {
+		return errors.New("ERROR: PROMOTE called on a server that is not a replica.\n")
+	}
+	s.primary = ""
+	if s.follow != nil {
+		s.follow.Close()
+	}
+	return nil
+}
+
+// stream sends the replication stream to a replica until it disconnects.
+func (s *server) stream(conn net.Conn, reader *bufio.Reader) {
+	s.mu.Lock()
+	replication, err := storage.StartReplication(s.root)
+	s.mu.Unlock()
+	if err != nil {
+		log.Printf("Replication to %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	// The replica sends nothing more, reading only notices when it disconnects.
+	go func() {
+		io.Copy(io.Discard, reader)
+		s.mu.Lock()
+		replication.Stop()
+		s.mu.Unlock()
+	}()
+	if err := replication.Send(conn); err != nil {
+		log.Printf("Replication to %s failed: %v", conn.RemoteAddr(), err)
+	}
+	s.mu.Lock()
+	replication.Stop()
+	s.mu.Unlock()
+}
+
+// serve accepts client connections and starts a session for each of them.
+func (s *server) serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.session(conn)
+	}
+}
+
+// session reads commands from the client and executes them on the session's
+// transaction stack until the client sends QUIT or disconnects. Any transaction
+// still open when the session ends is discarded.
+func (s *server) session(conn net.Conn) {
+	defer conn.Close()
+
+	currentTx := storage.WithAccounts(s.root, s.accounts)
+	watched := newWatches()
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		// Abort the open transactions, if any, and stop watching.
+		storage.ExecuteOp("ABORT", []string{"ALL"}, currentTx)
+		watched.close()
+	}()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	// Change events are written as soon as they are committed, by other sessions too.
+	// writeMu serializes them with the responses.
+	var writeMu sync.Mutex
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-watched.ready:
+				writeMu.Lock()
+				writeEvents(writer, watched.take())
+				writeMu.Unlock()
+			}
+		}
+	}()
+	respond := func(out string, err error) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+
+		// The events committed by the command come before its response.
+		if err := writeEvents(writer, watched.take()); err != nil {
+			return err
+		}
+		return writeResponse(writer, out, err)
+	}
+
+	for {
+		input, err := reader.ReadString('\n')
+		if err != nil && (err != io.EOF || input == "") {
+			return
+		}
+
+		cmd, args, err := parseArgs(input)
+		if err != nil {
+			if err := respond("", err); err != nil {
+				return
+			}
+			continue
+		}
+		switch strings.ToUpper(cmd) {
+		case "QUIT":
+			respond("", nil)
+			return
+		case "REPLICATE":
+			// The connection is a replica, it only receives the replication stream.
+			if err := storage.AuthorizeReadAll("REPLICATE", currentTx); err != nil {
+				respond("", err)
+				return
+			}
+			s.stream(conn, reader)
+			return
+		}
+
+		var out string
+		s.mu.Lock()
+		var handled bool
+		if handled, err = watched.execute(cmd, args, currentTx); !handled {
+			switch {
+			case strings.ToUpper(cmd) == "PROMOTE":
+				err = s.promote()
+			case s.primary != "" && !readCommands[strings.ToUpper(cmd)]:
+				err = fmt.Errorf("ERROR: %s called on a read-only replica.\n", strings.ToUpper(cmd))
+			default:
+				if args, err = s.dumpArgs(cmd, args); err == nil {
+					currentTx, out, err = storage.ExecuteOp(cmd, args, currentTx)
+				}
+			}
+		}
+		s.mu.Unlock()
+
+		if err := respond(out, err); err != nil {
+			return
+		}
+	}
+}
+
+// dumpArgs returns the arguments of DUMP and LOAD with the file joined to the
+// dump directory. The file must be a relative path that stays inside of it,
+// also once the symbolic links on the way are followed. The arguments of any
+// other command are returned as they are.
+func (s *server) dumpArgs(cmd string, args []string) ([]string, error) {
+	cmd = strings.ToUpper(cmd)
+	if cmd != "DUMP" && cmd != "LOAD" {
+		return args, nil
+	}
+	if s.dumpDir == "" {
+		return nil, fmt.Errorf("ERROR: %s is disabled on the server, start it with -dump-dir.\n", cmd)
+	}
+	if len(args) == 0 || args[0] == "" {
+		return args, nil
+	}
+
+	path := args[0]
+	if filepath.IsAbs(path) {
+		return nil, fmt.Errorf("ERROR: %s called with the absolute path %s, use a path relative to the dump directory.\n", cmd, path)
+	}
+	leaves := fmt.Errorf("ERROR: %s called with the path %s, which leaves the dump directory.\n", cmd, path)
+	for _, elem := range strings.Split(filepath.ToSlash(path), "/") {
+		if elem == ".." {
+			return nil, leaves
+		}
+	}
+
+	dir, err := filepath.EvalSymlinks(s.dumpDir)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: %s failed: %v.\n", cmd, err)
+	}
+	resolved, err := resolvePath(filepath.Join(dir, filepath.Clean(path)))
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: %s failed: %v.\n", cmd, err)
+	}
+	if rel, err := filepath.Rel(dir, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, leaves
+	}
+
+	args = append([]string{resolved}, args[1:]...)
+	return args, nil
+}
+
+// resolvePath returns the path with every symbolic link followed. A file that
+// doesn't exist yet, e.g the file of a new dump, is resolved in its directory.
+func resolvePath(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return resolved, nil
+	}
+	if _, statErr := os.Lstat(path); !os.IsNotExist(statErr) {
+		return "", err
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(path)), nil
+}
+
+// writeResponse writes the output and error of a command to the client,
+// one marked line at a time, followed by the end of response marker.
+func writeResponse(writer *bufio.Writer, out string, err error) error {
+	if err != nil {
+		writeLines(writer, errorMarker, err.Error())
+
+		// Locally the newline output after a failed READ ends the error
+		// message, here every error line already ends with a newline.
+		if out == "\n" {
+			out = ""
+		}
+	}
+	if out != "" {
+		writeLines(writer, outputMarker, out)
+	}
+	fmt.Fprintf(writer, "%c\n", endMarker)
+	return writer.Flush()
+}
+
+// writeEvents writes the EVENT lines to the client.
+func writeEvents(writer *bufio.Writer, events string) error {
+	if events == "" {
+		return nil
+	}
+	writeLines(writer, eventMarker, events)
+	return writer.Flush()
+}
+
+// writeLines writes each line of text prefixed by the marker.
+func writeLines(writer *bufio.Writer, marker byte, text string) {
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		fmt.Fprintf(writer, "%c%s\n", marker, line)
+	}
+}
@@ -0,0 +1,305 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jessicagreben/misc-projects/simple-repl/pkg/storage"
+)
+
+// testClient sends commands to a test server and reads the responses.
+type testClient struct {
+	conn      net.Conn
+	responses *bufio.Reader
+}
+
+// startTestServer starts a server with an in-memory store on a random local port.
+func startTestServer(t *testing.T) string {
+	return startTestServerWith(t, nil)
+}
+
+// startTestServerWith starts a test server whose sessions authenticate with the accounts.
+func startTestServerWith(t *testing.T, accounts *storage.Accounts) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	s := &server{root: storage.NewRoot(), accounts: accounts}
+	go s.serve(ln)
+	return ln.Addr().String()
+}
+
+func dialTestClient(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{conn: conn, responses: bufio.NewReader(conn)}
+}
+
+// do sends the command and returns what the client prints to stdout and stderr.
+func (c *testClient) do(t *testing.T, input string) (string, string) {
+	fmt.Fprintf(c.conn, "%s\n", input)
+
+	var stdout, stderr bytes.Buffer
+	if err := readResponse(c.responses, &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String()
+}
+
+func TestServerSessions(t *testing.T) {
+	addr := startTestServer(t)
+	alice := dialTestClient(t, addr)
+	bob := dialTestClient(t, addr)
+
+	cases := []struct {
+		client *testClient
+		input  string
+		stdout string
+		stderr string
+	}{
+
+		// Writes outside of a transaction are visible to every session.
+		{alice, "WRITE a hello", "", ""},
+		{bob, "READ a", "hello\n", ""},
+
+		// Each session has its own transaction stack.
+		{alice, "START", "", ""},
+		{alice, "WRITE a hello-again", "", ""},
+		{alice, "READ a", "hello-again\n", ""},
+		{bob, "READ a", "hello\n", ""},
+		{bob, "COMMIT", "", "ERROR: COMMIT called with no active transaction.\n"},
+
+		// Committed operations reach the shared root store.
+		{alice, "COMMIT", "", ""},
+		{bob, "READ a", "hello-again\n", ""},
+
+		// Aborted operations never reach the shared root store.
+		{bob, "START", "", ""},
+		{bob, "DELETE a", "", ""},
+		{bob, "READ a", "", "Key not found: a\n"},
+		{bob, "ABORT", "", ""},
+		{alice, "READ a", "hello-again\n", ""},
+
+		// Quoted values keep their spaces and escaped newlines span output lines.
+		{alice, `WRITE b "hello world\nbye"`, "", ""},
+		{bob, "READ b", "hello world\nbye\n", ""},
+		{bob, `WRITE b "bye`, "", "ERROR: syntax error at column 9: unterminated quoted string.\n"},
+	}
+
+	for i, exp := range cases {
+		stdout, stderr := exp.client.do(t, exp.input)
+
+		// Is the correct output returned to the client?
+		if stdout != exp.stdout {
+			t.Fatalf("Failed case %d.\nActual: %q.\nExpected: %q.\n", i, stdout, exp.stdout)
+		}
+
+		// Is the correct error returned to the client?
+		if stderr != exp.stderr {
+			t.Fatalf("Failed case %d.\nActual: %q.\nExpected: %q.\n", i, stderr, exp.stderr)
+		}
+	}
+}
+
+func TestServerWatch(t *testing.T) {
+	addr := startTestServer(t)
+	alice := dialTestClient(t, addr)
+	bob := dialTestClient(t, addr)
+
+	bob.do(t, "WATCH user:*")
+	alice.do(t, "START")
+	alice.do(t, "WRITE user:1 alice")
+	alice.do(t, "WRITE other x")
+	alice.do(t, "COMMIT")
+
+	// Is the event of the other session's commit pushed to the watching session?
+	line, err := bob.responses.ReadString('\n')
+	if err != nil || line != "!EVENT 1 WRITE user:1 alice\n" {
+		t.Fatalf("Failed.\nActual: %q, %v.\nExpected: %q.\n", line, err, "!EVENT 1 WRITE user:1 alice\n")
+	}
+
+	// Are the events of the session's own commit written before the response?
+	stdout, _ := bob.do(t, "DELETE user:1")
+	if stdout != "EVENT 2 DELETE user:1\n" {
+		t.Fatalf("Failed.\nActual: %q.\nExpected: %q.\n", stdout, "EVENT 2 DELETE user:1\n")
+	}
+
+	// Are no more events pushed once the session stops watching?
+	bob.do(t, "UNWATCH user:*")
+	alice.do(t, "WRITE user:2 bob")
+	if stdout, stderr := bob.do(t, "UNWATCH user:*"); stdout != "" || stderr != "ERROR: UNWATCH called with unknown key or prefix user:*.\n" {
+		t.Fatalf("Failed.\nActual: %q, %q.\nExpected: no events.\n", stdout, stderr)
+	}
+}
+
+func TestServerQuit(t *testing.T) {
+	addr := startTestServer(t)
+	alice := dialTestClient(t, addr)
+	alice.do(t, "START")
+	alice.do(t, "WRITE a pending")
+	alice.do(t, "QUIT")
+
+	// Is the connection closed by the server?
+	if _, err := alice.responses.ReadString('\n'); err == nil {
+		t.Fatalf("Failed.\nActual: nil.\nExpected: EOF.\n")
+	}
+
+	// Is the open transaction of the session discarded?
+	bob := dialTestClient(t, addr)
+	if _, stderr := bob.do(t, "READ a"); stderr != "Key not found: a\n" {
+		t.Fatalf("Failed.\nActual: %q.\nExpected: %q.\n", stderr, "Key not found: a\n")
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	hash := func(secret string) string {
+		hash, err := storage.HashSecret(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	path := filepath.Join(t.TempDir(), "users.json")
+	content := fmt.Sprintf(`[
+		{"name": "admin", "token_hash": %q, "permissions": {"": "rw"}},
+		{"name": "bob", "token_hash": %q, "permissions": {"user:bob:": "rw"}}
+	]`, hash("token"), hash("bob"))
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	accounts, err := storage.LoadAccounts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := startTestServerWith(t, accounts)
+	admin := dialTestClient(t, addr)
+	bob := dialTestClient(t, addr)
+
+	cases := []struct {
+		client *testClient
+		input  string
+		stdout string
+		stderr string
+	}{
+
+		// Sessions must authenticate before accessing any key.
+		{admin, "WRITE a hello", "", "ERROR: WRITE called without authentication, use AUTH.\n"},
+		{admin, "AUTH token", "", ""},
+		{admin, "WRITE a hello", "", ""},
+
+		// Each session has the permissions of its own user.
+		{bob, "AUTH bob", "", ""},
+		{bob, "WATCH *", "", ""},
+		{bob, "READ a", "", "ERROR: READ called without read permission on a.\n"},
+		{bob, "WRITE user:bob:1 hi", "EVENT 2 WRITE user:bob:1 hi\n", ""},
+		{bob, "WATCH a", "", "ERROR: WATCH called without read permission on a.\n"},
+		{bob, "WATCH secret:*", "", "ERROR: WATCH called without read permission on secret:*.\n"},
+		{bob, "WATCH user:*", "", ""},
+
+		// The changes of keys the user may not read are not notified.
+		{admin, "WRITE b hello", "", ""},
+		{bob, "KEYS", "user:bob:1\n", ""},
+
+		// Replicas need read permission on every key.
+		{bob, "REPLICATE", "", "ERROR: REPLICATE called without read permission on every key.\n"},
+	}
+
+	for i, exp := range cases {
+		stdout, stderr := exp.client.do(t, exp.input)
+
+		// Is the correct output returned to the client?
+		if stdout != exp.stdout {
+			t.Fatalf("Failed case %d.\nActual: %q.\nExpected: %q.\n", i, stdout, exp.stdout)
+		}
+
+		// Is the correct error returned to the client?
+		if stderr != exp.stderr {
+			t.Fatalf("Failed case %d.\nActual: %q.\nExpected: %q.\n", i, stderr, exp.stderr)
+		}
+	}
+}
+
+func TestServerDump(t *testing.T) {
+	// Case setup: one server without a dump directory and one with it.
+	start := func(dumpDir string) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+
+		s := &server{root: storage.NewRoot(), dumpDir: dumpDir}
+		go s.serve(ln)
+		return ln.Addr().String()
+	}
+	dumpDir := t.TempDir()
+	outside := filepath.Join(t.TempDir(), "dump.json")
+
+	// Symbolic links in the dump directory to a file and a directory outside of it.
+	secret := filepath.Join(t.TempDir(), "secret.json")
+	os.WriteFile(secret, []byte(`[{"key": "a", "value": "secret"}]`), 0600)
+	os.Symlink(secret, filepath.Join(dumpDir, "link.json"))
+	os.Symlink(filepath.Dir(outside), filepath.Join(dumpDir, "elsewhere"))
+	disabled := dialTestClient(t, start(""))
+	client := dialTestClient(t, start(dumpDir))
+
+	cases := []struct {
+		client *testClient
+		input  string
+		stdout string
+		stderr string
+	}{
+
+		// Without a dump directory no file of the server can be read or written.
+		{disabled, "DUMP dump.json", "", "ERROR: DUMP is disabled on the server, start it with -dump-dir.\n"},
+		{disabled, "LOAD " + outside, "", "ERROR: LOAD is disabled on the server, start it with -dump-dir.\n"},
+
+		// The files must stay inside of the dump directory.
+		{client, "DUMP " + outside, "", "ERROR: DUMP called with the absolute path " + outside + ", use a path relative to the dump directory.\n"},
+		{client, "LOAD ../dump.json", "", "ERROR: LOAD called with the path ../dump.json, which leaves the dump directory.\n"},
+		{client, "DUMP a/../../dump.json", "", "ERROR: DUMP called with the path a/../../dump.json, which leaves the dump directory.\n"},
+		{client, "LOAD link.json", "", "ERROR: LOAD called with the path link.json, which leaves the dump directory.\n"},
+		{client, "DUMP link.json", "", "ERROR: DUMP called with the path link.json, which leaves the dump directory.\n"},
+		{client, "DUMP elsewhere/dump.json", "", "ERROR: DUMP called with the path elsewhere/dump.json, which leaves the dump directory.\n"},
+
+		// Relative paths are in the dump directory.
+		{client, "WRITE a hello", "", ""},
+		{client, "DUMP ./dump.json", "", ""},
+		{client, "DELETE a", "", ""},
+		{client, "LOAD dump.json", "", ""},
+		{client, "READ a", "hello\n", ""},
+	}
+
+	for i, exp := range cases {
+		stdout, stderr := exp.client.do(t, exp.input)
+
+		// Is the correct output returned to the client?
+		if stdout != exp.stdout {
+			t.Fatalf("Failed case %d.\nActual: %q.\nExpected: %q.\n", i, stdout, exp.stdout)
+		}
+
+		// Is the correct error returned to the client?
+		if stderr != exp.stderr {
+			t.Fatalf("Failed case %d.\nActual: %q.\nExpected: %q.\n", i, stderr, exp.stderr)
+		}
+	}
+
+	// Was the dump written in the dump directory, and nothing outside of it?
+	if _, err := os.Stat(filepath.Join(dumpDir, "dump.json")); err != nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: the dump in the dump directory.\n", err)
+	}
+	if _, err := os.Stat(outside); !os.IsNotExist(err) {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: no dump outside of the dump directory.\n", err)
+	}
+}
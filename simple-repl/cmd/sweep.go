@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jessicagreben/misc-projects/simple-repl/pkg/storage"
+)
+
+// sweepEvery is how often the background sweep reclaims expired keys.
+const sweepEvery = time.Second
+
+// sweep reclaims the expired keys of the root store every sweepEvery.
+// mu serializes the sweep with the operations on the root store.
+func sweep(root storage.Transaction, mu *sync.Mutex) {
+	ticker := time.NewTicker(sweepEvery)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		mu.Lock()
+		err := storage.SweepExpired(root)
+		mu.Unlock()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: unable to reclaim expired keys: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin
+
+package cmd
+
+import "errors"
+
+// isTerminal reports whether fd is a terminal. Line editing is only supported
+// on Linux and macOS, elsewhere stdin is always read like a pipe.
+func isTerminal(fd uintptr) bool {
+	return false
+}
+
+// makeRaw is not supported on this platform.
+func makeRaw(fd uintptr) (func(), error) {
+	return nil, errors.New("raw terminal mode is not supported")
+}
@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// tokenize splits a line of input into tokens separated by spaces or tabs.
+//
+// A token may contain double-quoted strings, so a value can hold spaces. Inside
+// quotes, escape sequences let a value hold quotes, newlines or any byte: \\, \",
+// \n, \r, \t, \0 and \xHH. Outside of quotes a backslash is an ordinary
+// character, e.g C:\dir. A token starting with x"...", with an even number of hex
+// digits inside the quotes, or b"...", with a multiple of 8 binary digits, is a
+// literal of the bytes it spells out, e.g x"6869" and b"0110100001101001" both
+// are the value hi. Any other text is kept as it is, e.g 0x6869.
+func tokenize(input string) ([]string, error) {
+	tokens := []string{}
+
+	var token strings.Builder
+	inToken := false // A token has started, it may still be empty, e.g "".
+	plain := false   // The token has no quotes so far.
+
+	for i := 0; i < len(input); {
+		c := input[i]
+
+		if !inToken && !isSpace(c) {
+			inToken, plain = true, true
+			token.Reset()
+		}
+
+		switch {
+		case isSpace(c):
+			if inToken {
+				tokens = append(tokens, token.String())
+				inToken = false
+			}
+			i++
+		case c == '"' && plain && token.Len() == 1 && strings.ContainsRune("xXbB", rune(input[i-1])):
+			plain = false
+			token.Reset()
+			end, err := readLiteral(input, i, &token)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+		case c == '"':
+			plain = false
+			end, err := readQuoted(input, i, &token)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+		default:
+			token.WriteByte(c)
+			i++
+		}
+	}
+
+	if inToken {
+		tokens = append(tokens, token.String())
+	}
+	return tokens, nil
+}
+
+// isSpace tells if c separates tokens. The newline ending the input is a separator too.
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// readQuoted reads the double-quoted string starting at input[start] into token
+// and returns the index following the closing quote.
+func readQuoted(input string, start int, token *strings.Builder) (int, error) {
+	for i := start + 1; i < len(input); {
+		switch input[i] {
+		case '"':
+			return i + 1, nil
+		case '\\':
+			end, err := readEscape(input, i, token)
+			if err != nil {
+				return 0, err
+			}
+			i = end
+		default:
+			token.WriteByte(input[i])
+			i++
+		}
+	}
+	return 0, syntaxError(input, start, "unterminated quoted string")
+}
+
+// readEscape reads the escape sequence of a quoted string starting at input[start]
+// into token and returns the index following the escape sequence.
+func readEscape(input string, start int, token *strings.Builder) (int, error) {
+	if start+1 >= len(input) || input[start+1] == '\n' || input[start+1] == '\r' {
+		return 0, syntaxError(input, start, "incomplete escape sequence")
+	}
+
+	switch c := input[start+1]; c {
+	case '\\', '"':
+		token.WriteByte(c)
+	case 'n':
+		token.WriteByte('\n')
+	case 'r':
+		token.WriteByte('\r')
+	case 't':
+		token.WriteByte('\t')
+	case '0':
+		token.WriteByte(0)
+	case 'x':
+		if start+4 > len(input) {
+			return 0, syntaxError(input, start, "\\x must be followed by two hex digits")
+		}
+		b, err := strconv.ParseUint(input[start+2:start+4], 16, 8)
+		if err != nil {
+			return 0, syntaxError(input, start, "\\x must be followed by two hex digits")
+		}
+		token.WriteByte(byte(b))
+		return start + 4, nil
+	default:
+		r, _ := utf8.DecodeRuneInString(input[start+1:])
+		return 0, syntaxError(input, start, fmt.Sprintf("unknown escape sequence \\%c", r))
+	}
+	return start + 2, nil
+}
+
+// readLiteral reads the hex or binary literal whose quoted digits start at
+// input[start], after the x or b prefix, into token and returns the index
+// following the closing quote.
+func readLiteral(input string, start int, token *strings.Builder) (int, error) {
+	end := strings.IndexByte(input[start+1:], '"')
+	if end < 0 {
+		return 0, syntaxError(input, start, "unterminated quoted string")
+	}
+	end += start + 1
+
+	digits := input[start+1 : end]
+	if prefix := input[start-1]; prefix == 'x' || prefix == 'X' {
+		value, err := hex.DecodeString(digits)
+		if err != nil {
+			return 0, syntaxError(input, start-1, "a hex literal must hold an even number of hex digits")
+		}
+		token.Write(value)
+	} else {
+		value, ok := decodeBinary(digits)
+		if !ok {
+			return 0, syntaxError(input, start-1, "a binary literal must hold groups of 8 binary digits")
+		}
+		token.Write(value)
+	}
+	return end + 1, nil
+}
+
+// decodeBinary decodes the bytes spelled out by groups of 8 binary digits.
+func decodeBinary(digits string) ([]byte, bool) {
+	if len(digits)%8 != 0 {
+		return nil, false
+	}
+	value := make([]byte, 0, len(digits)/8)
+	for i := 0; i < len(digits); i += 8 {
+		b, err := strconv.ParseUint(digits[i:i+8], 2, 8)
+		if err != nil {
+			return nil, false
+		}
+		value = append(value, byte(b))
+	}
+	return value, true
+}
+
+// syntaxError returns an error for the problem found at input[i]. The column
+// is counted in characters, starting at 1, so it points at the problem in the line.
+func syntaxError(input string, i int, problem string) error {
+	column := utf8.RuneCountInString(input[:i]) + 1
+	return fmt.Errorf("ERROR: syntax error at column %d: %s.\n", column, problem)
+}
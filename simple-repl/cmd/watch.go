@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jessicagreben/misc-projects/simple-repl/pkg/storage"
+)
+
+// watches are the WATCH subscriptions of a session. The change events of the
+// watched keys are queued until the session writes them out.
+type watches struct {
+	unwatch map[string]func()
+
+	mu     sync.Mutex
+	events []storage.Event
+
+	// ready is signaled when an event is queued.
+	ready chan struct{}
+}
+
+func newWatches() *watches {
+	return &watches{
+		unwatch: map[string]func(){},
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+// execute executes WATCH <key|prefix*> and UNWATCH <key|prefix*> in the current
+// transaction of the session. It returns false for any other command. Like
+// ExecuteOp it must be called while holding the lock on the root store.
+func (w *watches) execute(cmd string, args []string, currentTx storage.Transaction) (bool, error) {
+	switch strings.ToUpper(cmd) {
+	case "WATCH":
+		if len(args) == 0 || args[0] == "" {
+			return true, errors.New("ERROR: WATCH called without a key or prefix.\n")
+		}
+		pattern := args[0]
+		if _, watched := w.unwatch[pattern]; !watched {
+			unwatch, err := storage.Watch(currentTx, pattern, w.push)
+			if err != nil {
+				return true, err
+			}
+			w.unwatch[pattern] = unwatch
+		}
+		return true, nil
+	case "UNWATCH":
+		pattern := ""
+		if len(args) > 0 {
+			pattern = args[0]
+		}
+		unwatch, watched := w.unwatch[pattern]
+		if !watched {
+			return true, fmt.Errorf("ERROR: UNWATCH called with unknown key or prefix %s.\n", pattern)
+		}
+		unwatch()
+		delete(w.unwatch, pattern)
+		return true, nil
+	}
+	return false, nil
+}
+
+// push queues the event. It's called during the commit, so it doesn't block.
+func (w *watches) push(event storage.Event) {
+	w.mu.Lock()
+	w.events = append(w.events, event)
+	w.mu.Unlock()
+
+	select {
+	case w.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the queued events, one EVENT line per event, and empties the queue.
+func (w *watches) take() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var output strings.Builder
+	for _, event := range w.events {
+		output.WriteString("EVENT " + event.String() + "\n")
+	}
+	w.events = nil
+	return output.String()
+}
+
+// close stops every subscription. It must be called while holding the lock on the root store.
+func (w *watches) close() {
+	for pattern, unwatch := range w.unwatch {
+		unwatch()
+		delete(w.unwatch, pattern)
+	}
+}
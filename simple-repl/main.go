@@ -1,7 +1,63 @@
 package main
 
-import "github.com/jessicagreben/misc-projects/simple-repl/cmd"
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jessicagreben/misc-projects/simple-repl/cmd"
+	"github.com/jessicagreben/misc-projects/simple-repl/pkg/storage"
+)
 
 func main() {
-	cmd.Run()
+	dataDir := flag.String("data", "", "directory for the write-ahead log; the store is in-memory only when empty")
+	backend := flag.String("backend", "memory", "store backend for the data directory: memory or lsm")
+	listen := flag.String("listen", "", "serve the store to many clients on this TCP address, e.g. :7070")
+	accounts := flag.String("users", "", "with -listen, a JSON file of user accounts that sessions must authenticate as with AUTH")
+	replicateFrom := flag.String("replicate-from", "", "with -listen, serve a read-only replica of the server at this TCP address")
+	replicateToken := flag.String("replicate-token", "", "with -replicate-from, the token to authenticate to the primary with")
+	dumpDir := flag.String("dump-dir", "", "with -listen, the directory of the files of DUMP and LOAD; they are disabled when empty")
+	hashSecret := flag.Bool("hash-secret", false, "print the hash of the password or token read from stdin, for the accounts file of -users")
+	connect := flag.String("connect", "", "connect the REPL to the server at this TCP address, e.g. devbox:7070")
+	file := flag.String("file", "", "run the commands in this file, or stdin when -, without prompting")
+	continueOnError := flag.Bool("continue", false, "with -file, keep running the commands after a command fails")
+	history := flag.String("history", cmd.DefaultHistoryFile(), "file that keeps the lines typed in the REPL line editor; no history is kept when empty")
+	jsonOutput := flag.Bool("json", false, "with -file, write the result of every command as one JSON record per line")
+	flag.Parse()
+
+	var err error
+	switch {
+	case *hashSecret:
+		err = printHash(os.Stdin)
+	case *connect != "":
+		err = cmd.Connect(*connect)
+	case *file != "":
+		err = cmd.RunBatch(*file, *dataDir, *backend, cmd.BatchOptions{ContinueOnError: *continueOnError, JSON: *jsonOutput})
+	case *listen != "":
+		err = cmd.Serve(*listen, *dataDir, *backend, cmd.ServerOptions{Accounts: *accounts, Primary: *replicateFrom, PrimaryToken: *replicateToken, DumpDir: *dumpDir})
+	default:
+		cmd.Run(*dataDir, *backend, *history)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// printHash prints the hash of the secret on the first line of in.
+func printHash(in io.Reader) error {
+	secret, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	hash, err := storage.HashSecret(strings.TrimRight(secret, "\r\n"))
+	if err != nil {
+		return err
+	}
+	fmt.Println(hash)
+	return nil
 }
@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Hashes of passwords and tokens are derived with PBKDF2-SHA256 from the secret
+// and a random salt of their own, see HashSecret.
+const (
+	hashScheme = "pbkdf2-sha256"
+
+	// hashIterations makes guessing a secret from its hash slow.
+	hashIterations = 600000
+	hashSaltSize   = 16
+	hashKeySize    = 32
+)
+
+// Access is what a permission allows on the keys it applies to.
+type Access struct {
+	Read  bool
+	Write bool
+}
+
+// User is the user of a session. Permissions map key prefixes to the access
+// they grant, the longest prefix a key starts with applies to the key. A user
+// without a name is a session that has not authenticated yet.
+type User struct {
+	Name        string
+	Permissions map[string]Access
+}
+
+// Accounts are the users that can authenticate to a server.
+type Accounts struct {
+	users []account
+}
+
+// account is a user in an accounts file. Only the hashes of the password and of
+// the token are kept, see HashSecret, the user authenticates with either.
+// Permissions map key prefixes to "r", "w", "rw" or "" for no access.
+//
+// The unsalted SHA-256 hashes of older accounts files are only read to reject them.
+type account struct {
+	Name         string            `json:"name"`
+	PasswordHash string            `json:"password_hash,omitempty"`
+	TokenHash    string            `json:"token_hash,omitempty"`
+	Permissions  map[string]string `json:"permissions"`
+
+	PasswordSHA256 string `json:"password_sha256,omitempty"`
+	TokenSHA256    string `json:"token_sha256,omitempty"`
+
+	user *User
+}
+
+// keyAccess is the access each command needs on its key argument.
+var keyAccess = map[string]Access{
+	"READ":    {Read: true},
+	"EXISTS":  {Read: true},
+	"TTL":     {Read: true},
+	"WRITE":   {Write: true},
+	"DELETE":  {Write: true},
+	"PERSIST": {Read: true, Write: true},
+	"INCR":    {Read: true, Write: true},
+	"DECR":    {Read: true, Write: true},
+	"INCRBY":  {Read: true, Write: true},
+	"APPEND":  {Read: true, Write: true},
+	"CAS":     {Read: true, Write: true},
+}
+
+// storeAccess is the access each command needs on every key of the store.
+var storeAccess = map[string]Access{
+	"DUMP":     {Read: true},
+	"SNAPSHOT": {Write: true},
+}
+
+// LoadAccounts reads the accounts file at path, a JSON array of accounts.
+func LoadAccounts(path string) (*Accounts, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []account
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("reading accounts %s failed: %v", path, err)
+	}
+
+	names := map[string]bool{}
+	for i, user := range users {
+		if user.Name == "" || names[user.Name] {
+			return nil, fmt.Errorf("account %d needs a unique name", i+1)
+		}
+		names[user.Name] = true
+
+		if user.PasswordSHA256 != "" || user.TokenSHA256 != "" {
+			return nil, fmt.Errorf("account %s has an unsalted SHA-256 hash, replace it with a password_hash or token_hash from -hash-secret", user.Name)
+		}
+		for _, hash := range []string{user.PasswordHash, user.TokenHash} {
+			if _, _, _, err := parseHash(hash); hash != "" && err != nil {
+				return nil, fmt.Errorf("account %s: %v", user.Name, err)
+			}
+		}
+
+		permissions := map[string]Access{}
+		for prefix, access := range user.Permissions {
+			if strings.Trim(access, "rw") != "" {
+				return nil, fmt.Errorf("permission %q of %s must be r, w, rw or empty", access, user.Name)
+			}
+			permissions[prefix] = Access{Read: strings.Contains(access, "r"), Write: strings.Contains(access, "w")}
+		}
+		users[i].user = &User{Name: user.Name, Permissions: permissions}
+	}
+	return &Accounts{users: users}, nil
+}
+
+// WithAccounts returns the root transaction of a session that must authenticate
+// with one of the accounts, using AUTH, before it can access any key.
+func WithAccounts(root Transaction, accounts *Accounts) Transaction {
+	if accounts != nil {
+		root.accounts = accounts
+		root.user = &User{}
+	}
+	return root
+}
+
+// authTx authenticates the session with AUTH <user> <password> or AUTH <token>.
+// The transaction stack of the session must be empty.
+func authTx(args []string, currentTx Transaction) (Transaction, error) {
+	if currentTx.accounts == nil {
+		return currentTx, errors.New("ERROR: AUTH called without user accounts.\n")
+	}
+	if currentTx.parent != nil {
+		return currentTx, errors.New("ERROR: AUTH called with an active transaction.\n")
+	}
+
+	var user *User
+	switch len(args) {
+	case 1:
+		user = currentTx.accounts.match(func(a account) bool {
+			return a.TokenHash != "" && sameHash(a.TokenHash, args[0])
+		})
+	case 2:
+		user = currentTx.accounts.match(func(a account) bool {
+			return a.Name == args[0] && a.PasswordHash != "" && sameHash(a.PasswordHash, args[1])
+		})
+	}
+	if user == nil {
+		return currentTx, errors.New("ERROR: AUTH failed, wrong user, password or token.\n")
+	}
+
+	currentTx.user = user
+	return currentTx, nil
+}
+
+// match returns the user of the first account for which fn returns true, if any.
+func (a *Accounts) match(fn func(a account) bool) *User {
+	for _, user := range a.users {
+		if fn(user) {
+			return user.user
+		}
+	}
+	return nil
+}
+
+// HashSecret returns the hash of a password or token as kept in accounts files:
+// pbkdf2-sha256$<iterations>$<salt>$<key>, the salt and the key hex encoded.
+// Every hash has a salt of its own, so equal secrets have different hashes.
+func HashSecret(secret string) (string, error) {
+	return hashSecretWith(secret, hashIterations)
+}
+
+// hashSecretWith returns the hash of the secret derived with the iterations.
+func hashSecretWith(secret string, iterations int) (string, error) {
+	salt := make([]byte, hashSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, secret, salt, iterations, hashKeySize)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s$%d$%s$%s", hashScheme, iterations, hex.EncodeToString(salt), hex.EncodeToString(key)), nil
+}
+
+// parseHash returns the iterations, the salt and the key of a hash written by HashSecret.
+func parseHash(hash string) (int, []byte, []byte, error) {
+	invalid := fmt.Errorf("hash must be %s$<iterations>$<salt>$<key>", hashScheme)
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != hashScheme {
+		return 0, nil, nil, invalid
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return 0, nil, nil, invalid
+	}
+	salt, err := hex.DecodeString(parts[2])
+	if err != nil || len(salt) == 0 {
+		return 0, nil, nil, invalid
+	}
+	key, err := hex.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return 0, nil, nil, invalid
+	}
+	return iterations, salt, key, nil
+}
+
+// sameHash reports whether the hash, see HashSecret, is the hash of the secret.
+func sameHash(hash, secret string) bool {
+	iterations, salt, key, err := parseHash(hash)
+	if err != nil {
+		return false
+	}
+	sum, err := pbkdf2.Key(sha256.New, secret, salt, iterations, len(key))
+	return err == nil && subtle.ConstantTimeCompare(sum, key) == 1
+}
+
+// access returns the access the user has on the key.
+func (u *User) access(key string) Access {
+	longest, access := -1, Access{}
+	for prefix, prefixAccess := range u.Permissions {
+		if strings.HasPrefix(key, prefix) && len(prefix) > longest {
+			longest, access = len(prefix), prefixAccess
+		}
+	}
+	return access
+}
+
+// accessAll returns the access the user has on every key.
+func (u *User) accessAll() Access {
+	access, granted := u.Permissions[""]
+	if !granted {
+		return Access{}
+	}
+	for _, prefixAccess := range u.Permissions {
+		access.Read = access.Read && prefixAccess.Read
+		access.Write = access.Write && prefixAccess.Write
+	}
+	return access
+}
+
+// authorize returns an error if the user of the session may not execute the
+// command: a command on a key needs access to the key, see keyAccess, and a
+// command on the whole store needs access to every key, see storeAccess.
+func authorize(cmd, key string, currentTx Transaction) error {
+	if need, onKey := keyAccess[cmd]; onKey {
+		return checkAccess(cmd, key, need, currentTx)
+	}
+	if need, onStore := storeAccess[cmd]; onStore {
+		return checkAccessAll(cmd, need, currentTx)
+	}
+	return nil
+}
+
+// AuthorizeReadAll returns an error unless the user of the session may read every key.
+func AuthorizeReadAll(cmd string, currentTx Transaction) error {
+	return checkAccessAll(cmd, Access{Read: true}, currentTx)
+}
+
+// checkAccess returns an error if the user of the session doesn't have the access to the key.
+func checkAccess(cmd, key string, need Access, currentTx Transaction) error {
+	if currentTx.user == nil {
+		return nil
+	}
+	if err := unauthenticated(cmd, currentTx); err != nil {
+		return err
+	}
+	if !allows(currentTx.user.access(key), need) {
+		return fmt.Errorf("ERROR: %s called without %s permission on %s.\n", cmd, accessName(need), key)
+	}
+	return nil
+}
+
+// checkAccessAll returns an error if the user of the session doesn't have the access to every key.
+func checkAccessAll(cmd string, need Access, currentTx Transaction) error {
+	if currentTx.user == nil {
+		return nil
+	}
+	if err := unauthenticated(cmd, currentTx); err != nil {
+		return err
+	}
+	if !allows(currentTx.user.accessAll(), need) {
+		return fmt.Errorf("ERROR: %s called without %s permission on every key.\n", cmd, accessName(need))
+	}
+	return nil
+}
+
+// checkWatch returns an error if the user of the session may read none of the
+// keys matching the pattern of a watcher, see Watch.
+func checkWatch(pattern string, currentTx Transaction) error {
+	prefix := strings.TrimSuffix(pattern, "*")
+	if prefix == pattern {
+		return checkAccess("WATCH", pattern, Access{Read: true}, currentTx)
+	}
+	if currentTx.user == nil {
+		return nil
+	}
+	if err := unauthenticated("WATCH", currentTx); err != nil {
+		return err
+	}
+	if currentTx.user.access(prefix).Read {
+		return nil
+	}
+	for permPrefix, access := range currentTx.user.Permissions {
+		if strings.HasPrefix(permPrefix, prefix) && access.Read {
+			return nil
+		}
+	}
+	return fmt.Errorf("ERROR: WATCH called without read permission on %s.\n", pattern)
+}
+
+// allows reports whether the access includes the access needed.
+func allows(access, need Access) bool {
+	return (access.Read || !need.Read) && (access.Write || !need.Write)
+}
+
+// canRead reports whether the user of the session may read the key.
+func canRead(key string, currentTx Transaction) bool {
+	return currentTx.user == nil || currentTx.user.access(key).Read
+}
+
+// unauthenticated returns an error if the session has not authenticated yet.
+func unauthenticated(cmd string, currentTx Transaction) error {
+	if currentTx.user.Name == "" {
+		return fmt.Errorf("ERROR: %s called without authentication, use AUTH.\n", cmd)
+	}
+	return nil
+}
+
+// accessName names the access in permission errors.
+func accessName(access Access) string {
+	switch {
+	case access.Read && access.Write:
+		return "read and write"
+	case access.Write:
+		return "write"
+	}
+	return "read"
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// hashSecret returns the hash of the secret, as kept in accounts files,
+// derived with few iterations so the tests run fast.
+func hashSecret(secret string) string {
+	hash, err := hashSecretWith(secret, 1000)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+}
+
+// writeAccounts writes the accounts file and returns its path.
+func writeAccounts(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "users.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAuth(t *testing.T) {
+	accounts, err := LoadAccounts(writeAccounts(t, fmt.Sprintf(`[
+		{"name": "admin", "password_hash": %q, "permissions": {"": "rw"}},
+		{"name": "reporter", "token_hash": %q, "permissions": {"": "r", "secret:": ""}},
+		{"name": "alice", "password_hash": %q, "permissions": {"user:": "r", "user:alice:": "rw"}}
+	]`, hashSecret("secret"), hashSecret("token"), hashSecret("pw"))))
+	if err != nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", err, nil)
+	}
+
+	cases := []struct {
+		name   string
+		inputs [][]string
+		output string
+		err    string
+	}{
+		{
+			name:   "not authenticated",
+			inputs: [][]string{{"READ", "a"}},
+			err:    "ERROR: READ called without authentication, use AUTH.\n",
+		},
+		{
+			name:   "wrong password",
+			inputs: [][]string{{"AUTH", "admin", "wrong"}, {"AUTH", "reporter", "token"}, {"AUTH", "wrong"}},
+			err:    "ERROR: AUTH failed, wrong user, password or token.\nERROR: AUTH failed, wrong user, password or token.\nERROR: AUTH failed, wrong user, password or token.\n",
+		},
+		{
+			name:   "password",
+			inputs: [][]string{{"AUTH", "admin", "secret"}, {"WRITE", "a", "2"}, {"READ", "a"}, {"DUMP", filepath.Join(t.TempDir(), "dump.json")}},
+			output: "2\n",
+		},
+		{
+			name:   "token with read permission",
+			inputs: [][]string{{"AUTH", "token"}, {"READ", "a"}, {"WRITE", "a", "2"}, {"INCR", "a"}},
+			output: "1\n",
+			err:    "ERROR: WRITE called without write permission on a.\nERROR: INCR called without read and write permission on a.\n",
+		},
+		{
+			name:   "longest prefix applies",
+			inputs: [][]string{{"AUTH", "token"}, {"READ", "secret:x"}, {"KEYS"}, {"PREFIX", "s"}, {"HISTORY", "2"}},
+			output: "a\nuser:alice:1\nuser:bob:1\n3 WRITE user:alice:1 alice\n4 WRITE user:bob:1 bob\n",
+			err:    "ERROR: READ called without read permission on secret:x.\n",
+		},
+		{
+			name:   "permission on a prefix",
+			inputs: [][]string{{"AUTH", "alice", "pw"}, {"WRITE", "user:alice:2", "x"}, {"WRITE", "user:bob:2", "x"}, {"READ", "user:bob:1"}, {"WRITE", "a", "x"}},
+			output: "bob\n",
+			err:    "ERROR: WRITE called without write permission on user:bob:2.\nERROR: WRITE called without write permission on a.\n",
+		},
+		{
+			name:   "nested transactions keep the user",
+			inputs: [][]string{{"AUTH", "alice", "pw"}, {"START"}, {"START"}, {"WRITE", "user:alice:2", "x"}, {"DELETE", "a"}, {"AUTH", "admin", "secret"}},
+			err:    "ERROR: DELETE called without write permission on a.\nERROR: AUTH called with an active transaction.\n",
+		},
+		{
+			name:   "store commands need permission on every key",
+			inputs: [][]string{{"AUTH", "token"}, {"DUMP", "dump.json"}, {"SNAPSHOT"}},
+			err:    "ERROR: DUMP called without read permission on every key.\nERROR: SNAPSHOT called without write permission on every key.\n",
+		},
+	}
+
+	for _, exp := range cases {
+		// Case setup: keys written without a session user.
+		root := NewRoot()
+		for _, input := range [][]string{{"WRITE", "a", "1"}, {"WRITE", "secret:x", "x"}, {"WRITE", "user:alice:1", "alice"}, {"WRITE", "user:bob:1", "bob"}} {
+			ExecuteOp(input[0], input[1:], root)
+		}
+
+		currentTx := WithAccounts(root, accounts)
+		var output, errs string
+		for _, input := range exp.inputs {
+			var out string
+			var err error
+			currentTx, out, err = ExecuteOp(input[0], input[1:], currentTx)
+			output += out
+			if err != nil {
+				errs += err.Error()
+			}
+		}
+
+		// Is the output correct?
+		if output != exp.output {
+			t.Fatalf("Failed %s.\nActual: %q.\nExpected: %q.\n", exp.name, output, exp.output)
+		}
+
+		// Are the permission errors correct?
+		if errs != exp.err {
+			t.Fatalf("Failed %s.\nActual: %q.\nExpected: %q.\n", exp.name, errs, exp.err)
+		}
+	}
+}
+
+func TestLoadAccounts(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{
+			name:    "unknown permission",
+			content: `[{"name": "admin", "permissions": {"": "x"}}]`,
+			err:     `permission "x" of admin must be r, w, rw or empty`,
+		},
+		{
+			name:    "duplicate name",
+			content: `[{"name": "admin"}, {"name": "admin"}]`,
+			err:     "account 2 needs a unique name",
+		},
+		{
+			name:    "unsalted hash",
+			content: `[{"name": "admin", "password_sha256": "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"}]`,
+			err:     "account admin has an unsalted SHA-256 hash, replace it with a password_hash or token_hash from -hash-secret",
+		},
+		{
+			name:    "invalid hash",
+			content: `[{"name": "admin", "token_hash": "pbkdf2-sha256$0$00$00"}]`,
+			err:     "account admin: hash must be pbkdf2-sha256$<iterations>$<salt>$<key>",
+		},
+	}
+
+	for _, exp := range cases {
+		_, err := LoadAccounts(writeAccounts(t, exp.content))
+
+		// Is the invalid accounts file rejected?
+		if err == nil || err.Error() != exp.err {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: %v.\n", exp.name, err, exp.err)
+		}
+	}
+}
+
+func TestHashSecret(t *testing.T) {
+	first, second := hashSecret("secret"), hashSecret("secret")
+
+	// Does every hash have its own salt?
+	if first == second {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: different hashes.\n", first)
+	}
+
+	// Does only the secret match the hash?
+	if !sameHash(first, "secret") || !sameHash(second, "secret") || sameHash(first, "other") {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", sameHash(first, "other"), "only secret matches")
+	}
+}
+
+func TestAuthWithoutAccounts(t *testing.T) {
+	_, _, err := ExecuteOp("AUTH", []string{"token"}, NewRoot())
+
+	// Does a session without accounts refuse AUTH?
+	expected := "ERROR: AUTH called without user accounts.\n"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", err, expected)
+	}
+}
@@ -0,0 +1,291 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+)
+
+// db is the state shared by a root transaction and every transaction started from it.
+//
+// Every commit that reaches the root transaction gets a version number from the
+// clock. A transaction reads the root transaction as of the snapshot, i.e the
+// clock value, pinned when it started, so it never sees commits made after that.
+// While snapshots are pinned, the values they can see are kept as versions next
+// to the latest values in the root transaction. Versions that no pinned snapshot
+// can see anymore are garbage-collected.
+type db struct {
+
+	// clock counts the commits that reached the root transaction.
+	clock uint64
+
+	// modified holds the clock value of the last commit that changed each key.
+	// It's used to detect conflicts, so only commits newer than the oldest
+	// pinned snapshot are kept.
+	modified map[string]uint64
+
+	// versions holds, oldest first, the committed values of each key that a pinned
+	// snapshot may still see. Keys without versions have not changed since the
+	// oldest pinned snapshot, their value is the one in the root transaction.
+	versions map[string][]version
+
+	// pinned counts the open transactions reading from each snapshot.
+	pinned map[uint64]int
+
+	// history holds, oldest first, up to historySize of the most recent
+	// operations committed to the root transaction.
+	history []historyEntry
+
+	// watchers are called with the changes committed to the root transaction.
+	watchers    map[int]func(commit uint64, ops map[string]Op)
+	nextWatcher int
+
+	// err is the first error reading the store of the root transaction
+	// since the last command, see getRoot.
+	err error
+}
+
+// version is the last operation on a key as of a commit. The first version
+// of a key that had never been written before doesn't exist.
+type version struct {
+	clock  uint64
+	op     Op
+	exists bool
+}
+
+// NewRoot returns an empty root transaction kept in memory.
+func NewRoot() Transaction {
+	return NewRootWith(newStore())
+}
+
+// NewRootWith returns a root transaction whose operations are kept in the store.
+func NewRootWith(store Store) Transaction {
+	root := Transaction{
+		store: store,
+		db: &db{
+			modified: map[string]uint64{},
+			versions: map[string][]version{},
+			pinned:   map[uint64]int{},
+			watchers: map[int]func(commit uint64, ops map[string]Op){},
+		},
+	}
+
+	// The operations of an in-memory store are the operations of the root transaction.
+	if ops, ok := store.(memStore); ok {
+		root.Operations = ops
+	}
+	return root
+}
+
+// fail keeps the first error reading the store of the root transaction.
+func (d *db) fail(err error) {
+	if d != nil && d.err == nil {
+		d.err = err
+	}
+}
+
+// takeErr returns and clears the error reading the store of the root transaction.
+func (d *db) takeErr() error {
+	if d == nil {
+		return nil
+	}
+	err := d.err
+	d.err = nil
+	return err
+}
+
+// now returns the clock value of the last commit that reached the root transaction.
+func (d *db) now() uint64 {
+	if d == nil {
+		return 0
+	}
+	return d.clock
+}
+
+// pin registers an open transaction reading from the snapshot.
+func (d *db) pin(snapshot uint64) {
+	if d == nil {
+		return
+	}
+	d.pinned[snapshot]++
+}
+
+// unpin unregisters a finished transaction reading from the snapshot
+// and garbage-collects the versions no snapshot can see anymore.
+func (d *db) unpin(snapshot uint64) {
+	if d == nil {
+		return
+	}
+	d.pinned[snapshot]--
+	if d.pinned[snapshot] <= 0 {
+		delete(d.pinned, snapshot)
+	}
+	d.gc()
+}
+
+// oldest returns the oldest pinned snapshot, or the clock if there is none.
+func (d *db) oldest() uint64 {
+	oldest := d.clock
+	for snapshot := range d.pinned {
+		if snapshot < oldest {
+			oldest = snapshot
+		}
+	}
+	return oldest
+}
+
+// read returns the operation on the key as of the snapshot and whether the key
+// existed. It returns false as the last value if the key has no versions, then
+// the latest operation in the root transaction is visible.
+func (d *db) read(key string, snapshot uint64) (Op, bool, bool) {
+	if d == nil {
+		return Op{}, false, false
+	}
+
+	versions := d.versions[key]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].clock <= snapshot {
+			return versions[i].op, versions[i].exists, true
+		}
+	}
+	return Op{}, false, false
+}
+
+// firstVersions returns the operations the pinned snapshots see on the keys
+// of the commit that have no versions yet. It's called before the operations
+// are applied to the root transaction, which then loses them.
+func (d *db) firstVersions(ops map[string]Op, root Transaction) map[string]version {
+	first := map[string]version{}
+	if d == nil || len(d.pinned) == 0 {
+		return first
+	}
+	for opKey := range ops {
+		if len(d.versions[opKey]) == 0 {
+			rootOp, keyExists := getRoot(opKey, root)
+			first[opKey] = version{clock: 0, op: rootOp, exists: keyExists}
+		}
+	}
+	return first
+}
+
+// committed gives the operations a new version number. It's called once the
+// operations are applied to the root transaction, with the first versions of
+// their keys, see firstVersions.
+func (d *db) committed(ops map[string]Op, first map[string]version) {
+	if d == nil || len(ops) == 0 {
+		return
+	}
+	d.clock++
+	d.record(ops)
+
+	// Without pinned snapshots there is no transaction that can conflict
+	// with the commit or read an older version.
+	if len(d.pinned) == 0 {
+		return
+	}
+
+	for opKey, op := range ops {
+		d.modified[opKey] = d.clock
+
+		// The first version of a key holds the operation the pinned snapshots see.
+		if len(d.versions[opKey]) == 0 {
+			d.versions[opKey] = []version{first[opKey]}
+		}
+		d.versions[opKey] = append(d.versions[opKey], version{clock: d.clock, op: op, exists: true})
+		d.gcKey(opKey, d.oldest())
+	}
+}
+
+// record adds the operations of the commit, sorted by key, to the history.
+func (d *db) record(ops map[string]Op) {
+	keys := []string{}
+	for opKey := range ops {
+		keys = append(keys, opKey)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		d.history = append(d.history, historyEntry{clock: d.clock, key: key, op: ops[key]})
+	}
+	if len(d.history) > historySize {
+		d.history = append([]historyEntry(nil), d.history[len(d.history)-historySize:]...)
+	}
+}
+
+// gc removes the versions and modifications that no pinned snapshot can see.
+func (d *db) gc() {
+	oldest := d.oldest()
+	for key := range d.versions {
+		d.gcKey(key, oldest)
+	}
+	for key, clock := range d.modified {
+		if clock <= oldest {
+			delete(d.modified, key)
+		}
+	}
+}
+
+// gcKey removes the versions of the key older than the newest version the
+// oldest snapshot can see. If only one version remains it's the latest value,
+// which is also in the root transaction, so the versions are dropped.
+func (d *db) gcKey(key string, oldest uint64) {
+	versions := d.versions[key]
+
+	visible := 0
+	for i, v := range versions {
+		if v.clock <= oldest {
+			visible = i
+		}
+	}
+	versions = versions[visible:]
+
+	if len(versions) <= 1 {
+		delete(d.versions, key)
+		return
+	}
+	d.versions[key] = versions
+}
+
+// validate returns a conflict error if a key the transaction read or wrote, or a
+// key in a range it scanned, was changed by another commit after the snapshot
+// the transaction reads from.
+func (d *db) validate(currentTx Transaction) error {
+	if d == nil {
+		return nil
+	}
+
+	keys := []string{}
+	for key := range currentTx.reads {
+		keys = append(keys, key)
+	}
+	for opKey := range currentTx.Operations {
+		if _, read := currentTx.reads[opKey]; !read {
+			keys = append(keys, opKey)
+		}
+	}
+	for key := range d.modified {
+		if inScannedRange(key, currentTx) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if d.modified[key] > currentTx.snapshot {
+			return fmt.Errorf("ERROR: COMMIT conflict, %s was changed by another transaction. The transaction was aborted.\n", key)
+		}
+	}
+	return nil
+}
+
+// inScannedRange reports whether the key is in a range the transaction scanned.
+func inScannedRange(key string, currentTx Transaction) bool {
+	if currentTx.scans == nil {
+		return false
+	}
+	for _, match := range *currentTx.scans {
+		if match(key) {
+			return true
+		}
+	}
+	return false
+}
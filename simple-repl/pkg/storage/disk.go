@@ -0,0 +1,380 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	walFileName = "wal.log"
+
+	// Each log record starts with a header holding the payload length
+	// followed by the CRC-32 checksum of the payload.
+	recordHeaderSize = 8
+
+	// maxRecordSize guards against allocating huge buffers when a corrupt
+	// header claims an unreasonable payload length. Larger records are never
+	// written, so a record that replay rejects is always a corrupt one.
+	maxRecordSize = 64 * 1024 * 1024
+)
+
+// Operation kinds recorded in the write-ahead log.
+const (
+	opWrite         byte = 1
+	opDelete        byte = 2
+	opWriteExpiring byte = 3 // A write followed by the expiry time in Unix nanoseconds.
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorruptRecord is returned when a log record can not be decoded.
+var errCorruptRecord = errors.New("corrupt log record")
+
+// disk is the on-disk write-ahead log of the root transaction.
+// Every commit that reaches the root transaction is appended to the log
+// as a single record before it is applied in memory. The log is compacted
+// by writing a snapshot of the root transaction and truncating the records
+// the snapshot covers.
+type disk struct {
+	dir  string
+	file *os.File
+
+	// seq is the sequence number of the last record in the log
+	// or, when the log is empty, of the last snapshot.
+	seq uint64
+
+	// records is the number of records in the log. A snapshot is taken
+	// once the log holds snapshotEvery records.
+	records       int
+	snapshotEvery int
+
+	// failed is the error that left the end of the log unknown, if any.
+	// Nothing is appended after it, as replay would drop what follows.
+	failed error
+}
+
+// Open returns a root transaction whose commits are persisted to a write-ahead
+// log in dir. The newest valid snapshot is loaded and the log records that follow
+// it are replayed so the root transaction holds every previously committed
+// operation. A torn or corrupt record at the end of the log is truncated away
+// instead of failing the recovery. An invalid snapshot whose records are not
+// all in the log fails the recovery, instead of losing its operations.
+func Open(dir string) (Transaction, error) {
+	root := NewRootWith(NewMemStore())
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return root, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return root, err
+	}
+
+	d := &disk{
+		dir:           dir,
+		file:          file,
+		snapshotEvery: defaultSnapshotEvery,
+	}
+
+	// Rebuild the root transaction from the newest snapshot and the records in the log.
+	apply := func(seq uint64, ops map[string]Op) {
+		for opKey, op := range ops {
+			root.Operations[opKey] = op
+		}
+	}
+	skipped, err := d.loadSnapshot(apply)
+	if err == nil {
+		err = d.replay(apply)
+	}
+	if err == nil && d.seq < skipped {
+		err = fmt.Errorf("snapshot %s is invalid and the write-ahead log doesn't hold the records it covers", snapshotName(skipped))
+	}
+	if err != nil {
+		file.Close()
+		return root, err
+	}
+
+	root.disk = d
+	return root, nil
+}
+
+// replay calls apply for every valid record in the log that is not covered by
+// the snapshot, in order. Reading stops at the first torn or corrupt record and
+// the log is truncated to the end of the last valid record so new records are
+// appended after it.
+func (d *disk) replay(apply func(seq uint64, ops map[string]Op)) error {
+	if _, err := d.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(d.file)
+	var offset int64
+	var prev uint64
+
+	for {
+		seq, ops, size, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+
+		// A record that can not be read completely, whose checksum does not match
+		// or that does not follow the previous record was only partially written
+		// when the process stopped.
+		if err == io.ErrUnexpectedEOF || err == errCorruptRecord || (err == nil && prev != 0 && seq != prev+1) {
+			fmt.Fprintf(os.Stderr, "WARNING: truncating corrupt write-ahead log tail at offset %d.\n", offset)
+			if err := d.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		prev = seq
+		offset += size
+		d.records++
+
+		// Skip the records the snapshot already covers. This happens when the
+		// process stopped after writing a snapshot but before truncating the log.
+		if seq <= d.seq {
+			continue
+		}
+		if seq != d.seq+1 {
+			return fmt.Errorf("write-ahead log is missing records %d to %d", d.seq+1, seq-1)
+		}
+
+		apply(seq, ops)
+		d.seq = seq
+	}
+
+	_, err := d.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// append writes the operations as one record to the end of the log and
+// syncs the log to stable storage. Operations that don't fit in one record
+// are rejected, so the commit fails instead of being lost on replay. Room is
+// left for a larger sequence number, so each operation also fits in a
+// snapshot record of its own, see writeSnapshot.
+//
+// A record that fails to be written or synced is truncated away, so the next
+// record doesn't follow a torn one. If that fails too, the log refuses every
+// further record.
+func (d *disk) append(ops map[string]Op) error {
+	if d.failed != nil {
+		return fmt.Errorf("write-ahead log failed: %v", d.failed)
+	}
+	record := encodeRecord(d.seq+1, ops)
+	if size := len(record) - recordHeaderSize; size > maxRecordSize-binary.MaxVarintLen64 {
+		return fmt.Errorf("ERROR: COMMIT of %d bytes is larger than the %d bytes limit of a log record.\n", size, maxRecordSize-binary.MaxVarintLen64)
+	}
+
+	offset, err := d.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = d.file.Write(record); err == nil {
+		err = d.file.Sync()
+	}
+	if err != nil {
+		d.undo(offset, err)
+		return err
+	}
+	d.seq++
+	d.records++
+	return nil
+}
+
+// undo truncates the log back to the offset after a record failed to be
+// written with err. The log fails if it can't be truncated.
+func (d *disk) undo(offset int64, err error) {
+	if truncErr := d.file.Truncate(offset); truncErr != nil {
+		d.failed = err
+		return
+	}
+	if _, seekErr := d.file.Seek(offset, io.SeekStart); seekErr != nil {
+		d.failed = err
+	}
+}
+
+// truncate removes every record from the log.
+func (d *disk) truncate() error {
+	if err := d.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := d.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := d.file.Sync(); err != nil {
+		return err
+	}
+	d.records = 0
+	return nil
+}
+
+// encodeRecord encodes the operations with their sequence number as a log record.
+func encodeRecord(seq uint64, ops map[string]Op) []byte {
+	payload := binary.AppendUvarint(nil, seq)
+	payload = binary.AppendUvarint(payload, uint64(len(ops)))
+	for opKey, op := range ops {
+		payload = appendOp(payload, opKey, op)
+	}
+
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	return append(record, payload...)
+}
+
+// readRecord reads the next record from the log. It returns the sequence number,
+// the operations and the size in bytes of the record.
+func readRecord(reader *bufio.Reader) (uint64, map[string]Op, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	n, err := io.ReadFull(reader, header)
+	if err == io.EOF {
+		return 0, nil, 0, io.EOF
+	}
+	if err != nil {
+		return 0, nil, 0, io.ErrUnexpectedEOF
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if length > maxRecordSize {
+		return 0, nil, 0, errCorruptRecord
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return 0, nil, 0, io.ErrUnexpectedEOF
+	}
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return 0, nil, 0, errCorruptRecord
+	}
+
+	seq, ops, err := decodePayload(payload)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	return seq, ops, int64(n) + int64(length), nil
+}
+
+// decodePayload decodes the sequence number and operations of a log record.
+func decodePayload(payload []byte) (uint64, map[string]Op, error) {
+	seq, payload, err := readUvarint(payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	count, payload, err := readUvarint(payload)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	ops := map[string]Op{}
+	for i := uint64(0); i < count; i++ {
+		var opKey string
+		var op Op
+		opKey, op, payload, err = readOp(payload)
+		if err != nil {
+			return 0, nil, err
+		}
+		ops[opKey] = op
+	}
+
+	if len(payload) != 0 {
+		return 0, nil, errCorruptRecord
+	}
+	return seq, ops, nil
+}
+
+// appendOp appends the operation on the key to buf.
+func appendOp(buf []byte, key string, op Op) []byte {
+	switch {
+	case op.Deleted:
+		buf = append(buf, opDelete)
+		buf = appendString(buf, key)
+	case !op.ExpiresAt.IsZero():
+		buf = append(buf, opWriteExpiring)
+		buf = appendString(buf, key)
+		buf = appendString(buf, op.Value)
+		buf = binary.AppendVarint(buf, op.ExpiresAt.UnixNano())
+	default:
+		buf = append(buf, opWrite)
+		buf = appendString(buf, key)
+		buf = appendString(buf, op.Value)
+	}
+	return buf
+}
+
+// readOp reads an operation on a key from the start of buf.
+func readOp(buf []byte) (string, Op, []byte, error) {
+	if len(buf) < 1 {
+		return "", Op{}, nil, errCorruptRecord
+	}
+	kind := buf[0]
+
+	key, buf, err := readString(buf[1:])
+	if err != nil {
+		return "", Op{}, nil, err
+	}
+
+	var op Op
+	switch kind {
+	case opWrite:
+		op.Value, buf, err = readString(buf)
+	case opWriteExpiring:
+		op.Value, buf, err = readString(buf)
+		if err != nil {
+			break
+		}
+		expiresAt, n := binary.Varint(buf)
+		if n <= 0 {
+			return "", Op{}, nil, errCorruptRecord
+		}
+		op.ExpiresAt = time.Unix(0, expiresAt)
+		buf = buf[n:]
+	case opDelete:
+		op = tombstone
+	default:
+		err = errCorruptRecord
+	}
+	if err != nil {
+		return "", Op{}, nil, err
+	}
+	return key, op, buf, nil
+}
+
+// appendString appends the length prefixed string to buf.
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// readString reads a length prefixed string from the start of buf.
+func readString(buf []byte) (string, []byte, error) {
+	length, buf, err := readUvarint(buf)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint64(len(buf)) < length {
+		return "", nil, errCorruptRecord
+	}
+	return string(buf[:length]), buf[length:], nil
+}
+
+// readUvarint reads a varint encoded integer from the start of buf.
+func readUvarint(buf []byte) (uint64, []byte, error) {
+	value, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return 0, nil, errCorruptRecord
+	}
+	return value, buf[n:], nil
+}
@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenReplaysLog(t *testing.T) {
+	dir := t.TempDir()
+
+	root, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: nil.\n", err)
+	}
+
+	// Operations on the root transaction and operations committed
+	// to the root transaction are persisted.
+	writeTx("a", "hello", root)
+	writeTx("b", "world", root)
+	writeTx("e", "", root)
+	child := startTx(root)
+	writeTx("a", "hello-again", child)
+	deleteTx("b", child)
+	commitTx(child)
+
+	// Operations of an aborted transaction are not persisted.
+	child = startTx(root)
+	writeTx("c", "aborted", child)
+	abortTx(child)
+	root.disk.file.Close()
+
+	recovered, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: nil.\n", err)
+	}
+	defer recovered.disk.file.Close()
+
+	cases := []struct {
+		key    string
+		output string
+		exists string
+	}{
+		{"a", "hello-again", "exists"},
+		{"b", "", "deleted"},
+		{"c", "", "never set"},
+		{"e", "", "exists"},
+	}
+
+	for _, exp := range cases {
+		actualOutput, _ := readTx(exp.key, recovered)
+
+		// Is the committed value of the key recovered?
+		if actualOutput != exp.output {
+			t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n",
+				actualOutput,
+				exp.output,
+			)
+		}
+
+		// Is a deletion recovered as a tombstone?
+		if actualExists := existsTx(exp.key, recovered); actualExists != exp.exists {
+			t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n",
+				actualExists,
+				exp.exists,
+			)
+		}
+	}
+
+	// Is the sequence number recovered so new records follow the existing ones?
+	if recovered.disk.seq != 4 {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", recovered.disk.seq, 4)
+	}
+}
+
+func TestOpenTruncatesCorruptTail(t *testing.T) {
+	cases := []struct {
+		name    string
+		corrupt func(record []byte) []byte
+	}{
+
+		// Case 1: the last record was only partially written.
+		{
+			name: "torn",
+			corrupt: func(record []byte) []byte {
+				return record[:len(record)-2]
+			},
+		},
+
+		// Case 2: the checksum of the last record does not match its payload.
+		{
+			name: "checksum",
+			corrupt: func(record []byte) []byte {
+				record[len(record)-1] ^= 0xff
+				return record
+			},
+		},
+	}
+
+	for _, exp := range cases {
+		dir := t.TempDir()
+		path := filepath.Join(dir, walFileName)
+
+		good := encodeRecord(1, map[string]Op{"a": {Value: "hello"}})
+		bad := exp.corrupt(encodeRecord(2, map[string]Op{"a": {Value: "hello-again"}}))
+		if err := os.WriteFile(path, append(good, bad...), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		root, err := Open(dir)
+
+		// Does recovery succeed even though the tail is corrupt?
+		if err != nil {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: nil.\n", exp.name, err)
+		}
+
+		// Is only the valid record replayed?
+		if root.Operations["a"].Value != "hello" {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: %v.\n", exp.name, root.Operations["a"], "hello")
+		}
+
+		// Is the corrupt tail removed from the log?
+		info, _ := os.Stat(path)
+		if info.Size() != int64(len(good)) {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: %v.\n", exp.name, info.Size(), len(good))
+		}
+
+		// Is a new record appended after the last valid record?
+		writeTx("b", "world", root)
+		root.disk.file.Close()
+		root, _ = Open(dir)
+		if root.Operations["b"].Value != "world" || root.disk.seq != 2 {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: %v.\n", exp.name, root.Operations, "a and b")
+		}
+		root.disk.file.Close()
+	}
+}
+
+func TestAppendRejectsLargeRecord(t *testing.T) {
+	dir := t.TempDir()
+	root, _ := Open(dir)
+	writeTx("a", "hello", root)
+
+	// Does a commit larger than a log record fail?
+	child := startTx(root)
+	writeTx("big", strings.Repeat("x", maxRecordSize), child)
+	child, err := commitTx(child)
+	if err == nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: an error.\n", err)
+	}
+
+	// Is the transaction still active, and is nothing of it applied?
+	if child.parent == nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", "root transaction", "active transaction")
+	}
+	abortTx(child)
+	if existsTx("big", root) != "never set" {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", existsTx("big", root), "never set")
+	}
+
+	// Are the commits before and after it recovered?
+	writeTx("b", "world", root)
+	root.disk.file.Close()
+	recovered, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: nil.\n", err)
+	}
+	defer recovered.disk.file.Close()
+	if recovered.Operations["a"].Value != "hello" || recovered.Operations["b"].Value != "world" {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", recovered.Operations, "a and b")
+	}
+}
+
+func TestAppendAfterFailedRecord(t *testing.T) {
+	dir := t.TempDir()
+	root, _ := Open(dir)
+	writeTx("a", "hello", root)
+
+	// Case setup: a record torn by a write that failed partway.
+	offset, _ := root.disk.file.Seek(0, io.SeekCurrent)
+	root.disk.file.Write(encodeRecord(root.disk.seq+1, map[string]Op{"lost": {Value: "lost"}})[:recordHeaderSize+1])
+	root.disk.undo(offset, errors.New("torn write"))
+
+	// Is the commit after it recovered?
+	if err := writeTx("b", "world", root); err != nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: nil.\n", err)
+	}
+	file := root.disk.file
+	recovered, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: nil.\n", err)
+	}
+	recovered.disk.file.Close()
+	if recovered.Operations["a"].Value != "hello" || recovered.Operations["b"].Value != "world" {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", recovered.Operations, "a and b")
+	}
+
+	// Does the log refuse every record once a failed one can't be truncated away?
+	readOnly, _ := os.Open(file.Name())
+	defer readOnly.Close()
+	root.disk.file = readOnly
+	if err := writeTx("c", "failed", root); err == nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: an error.\n", err)
+	}
+	root.disk.file = file
+	defer file.Close()
+	if err := writeTx("d", "refused", root); err == nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: an error.\n", err)
+	}
+}
@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Formats of the files written by DUMP and read by LOAD.
+const (
+	formatJSON = "JSON"
+	formatCSV  = "CSV"
+)
+
+// csvHeader is the first row of a CSV dump, naming the columns of dumpRecord.
+var csvHeader = []string{"key", "value", "encoding", "deleted", "expires_at"}
+
+// dumpRecord is the operation on one key in a dump. Keys and values that are
+// not valid UTF-8, or hold a carriage return that CSV readers turn into a plain
+// newline, are base64 encoded, which the encoding tells.
+type dumpRecord struct {
+	Key       string `json:"key"`
+	Value     string `json:"value,omitempty"`
+	Encoding  string `json:"encoding,omitempty"`
+	Deleted   bool   `json:"deleted,omitempty"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+// dumpTx writes the operations of the root transaction, deletions included,
+// to the file at path. The format is JSON or CSV, by default it's chosen by the
+// extension of the file. The transactions that are not committed are not dumped.
+func dumpTx(path, format string, currentTx Transaction) error {
+	if path == "" {
+		return errors.New("ERROR: DUMP called without a file.\n")
+	}
+	format, err := dumpFormat("DUMP", path, format)
+	if err != nil {
+		return err
+	}
+
+	records := []dumpRecord{}
+	iterateRoot(func(key string, op Op) bool {
+		records = append(records, newDumpRecord(key, op))
+		return true
+	}, rootTx(currentTx))
+	if err := currentTx.db.takeErr(); err != nil {
+		return fmt.Errorf("ERROR: DUMP failed: %v.\n", err)
+	}
+
+	var data bytes.Buffer
+	if format == formatJSON {
+		err = writeJSONDump(&data, records)
+	} else {
+		err = writeCSVDump(&data, records)
+	}
+	if err != nil {
+		return fmt.Errorf("ERROR: DUMP failed: %v.\n", err)
+	}
+
+	// Write the dump next to the file first, so a failed dump never replaces a good one.
+	tmpPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := writeFileSync(tmpPath, data.Bytes()); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("ERROR: DUMP failed: %v.\n", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("ERROR: DUMP failed: %v.\n", err)
+	}
+	return nil
+}
+
+// loadTx reads the operations in the file at path, in the format chosen like
+// dumpTx does, and applies them to the current transaction. Outside of a
+// transaction they are committed to the root transaction as one commit. Nothing
+// is loaded if the file can't be read completely.
+func loadTx(path, format string, currentTx Transaction) error {
+	if path == "" {
+		return errors.New("ERROR: LOAD called without a file.\n")
+	}
+	format, err := dumpFormat("LOAD", path, format)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("ERROR: LOAD failed: %v.\n", err)
+	}
+	defer file.Close()
+
+	var records []dumpRecord
+	if format == formatJSON {
+		records, err = readJSONDump(file)
+	} else {
+		records, err = readCSVDump(file)
+	}
+	if err != nil {
+		return fmt.Errorf("ERROR: LOAD of %s failed: %v.\n", path, err)
+	}
+
+	ops := map[string]Op{}
+	for i, record := range records {
+		key, op, err := record.op()
+		if err != nil {
+			return fmt.Errorf("ERROR: LOAD of %s failed: record %d: %v.\n", path, i+1, err)
+		}
+		if err := checkAccess("LOAD", key, Access{Write: true}, currentTx); err != nil {
+			return err
+		}
+		ops[key] = op
+	}
+
+	if currentTx.parent == nil {
+		return commitRoot(ops, currentTx)
+	}
+	for opKey, op := range ops {
+		putTx(opKey, op, currentTx)
+	}
+	return nil
+}
+
+// dumpFormat returns the format of the dump file, the one named if any,
+// otherwise CSV for a .csv file and JSON for any other file.
+func dumpFormat(cmd, path, format string) (string, error) {
+	switch strings.ToUpper(format) {
+	case formatJSON, formatCSV:
+		return strings.ToUpper(format), nil
+	case "":
+		if strings.EqualFold(filepath.Ext(path), ".csv") {
+			return formatCSV, nil
+		}
+		return formatJSON, nil
+	}
+	return "", fmt.Errorf("ERROR: %s format %s is not supported, use JSON or CSV.\n", cmd, format)
+}
+
+// newDumpRecord returns the record of the operation on the key.
+func newDumpRecord(key string, op Op) dumpRecord {
+	record := dumpRecord{Key: key, Value: op.Value, Deleted: op.Deleted}
+	if !utf8.ValidString(key+op.Value) || strings.Contains(key+op.Value, "\r") {
+		record.Key = base64.StdEncoding.EncodeToString([]byte(key))
+		record.Value = base64.StdEncoding.EncodeToString([]byte(op.Value))
+		record.Encoding = "base64"
+	}
+	if !op.ExpiresAt.IsZero() {
+		record.ExpiresAt = op.ExpiresAt.UTC().Format(time.RFC3339Nano)
+	}
+	return record
+}
+
+// op returns the key and the operation of the record.
+func (record dumpRecord) op() (string, Op, error) {
+	key, value := record.Key, record.Value
+	switch record.Encoding {
+	case "":
+	case "base64":
+		decodedKey, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return "", Op{}, fmt.Errorf("key %s is not base64", key)
+		}
+		decodedValue, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", Op{}, fmt.Errorf("value of %s is not base64", key)
+		}
+		key, value = string(decodedKey), string(decodedValue)
+	default:
+		return "", Op{}, fmt.Errorf("encoding %s is not supported", record.Encoding)
+	}
+
+	op := Op{Value: value}
+	if record.Deleted {
+		op = tombstone
+	}
+	if record.ExpiresAt != "" && !record.Deleted {
+		expiresAt, err := time.Parse(time.RFC3339Nano, record.ExpiresAt)
+		if err != nil {
+			return "", Op{}, fmt.Errorf("expires_at %s is not an RFC 3339 time", record.ExpiresAt)
+		}
+		op.ExpiresAt = expiresAt
+	}
+	return key, op, nil
+}
+
+// writeJSONDump writes the records as a JSON array, one record per line.
+func writeJSONDump(w io.Writer, records []dumpRecord) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	for i, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		separator := ",\n"
+		if i == 0 {
+			separator = "\n"
+		}
+		if _, err := fmt.Fprintf(w, "%s%s", separator, line); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "\n]\n")
+	return err
+}
+
+// readJSONDump reads the records of a JSON dump.
+func readJSONDump(r io.Reader) ([]dumpRecord, error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+
+	var records []dumpRecord
+	if err := decoder.Decode(&records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// writeCSVDump writes the records as CSV rows following the csvHeader.
+func writeCSVDump(w io.Writer, records []dumpRecord) error {
+	writer := csv.NewWriter(w)
+	writer.Write(csvHeader)
+	for _, record := range records {
+		writer.Write([]string{record.Key, record.Value, record.Encoding, strconv.FormatBool(record.Deleted), record.ExpiresAt})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// readCSVDump reads the records of a CSV dump.
+func readCSVDump(r io.Reader) ([]dumpRecord, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = len(csvHeader)
+
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 || strings.Join(rows[0], ",") != strings.Join(csvHeader, ",") {
+		return nil, fmt.Errorf("the first row must be the header %s", strings.Join(csvHeader, ","))
+	}
+
+	records := []dumpRecord{}
+	for i, row := range rows[1:] {
+		deleted, err := strconv.ParseBool(row[3])
+		if row[3] == "" {
+			deleted, err = false, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("record %d: deleted %s is not true or false", i+1, row[3])
+		}
+		records = append(records, dumpRecord{Key: row[0], Value: row[1], Encoding: row[2], Deleted: deleted, ExpiresAt: row[4]})
+	}
+	return records, nil
+}
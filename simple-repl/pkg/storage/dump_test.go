@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// rootOps returns the operations of the root transaction.
+func rootOps(root Transaction) map[string]Op {
+	ops := map[string]Op{}
+	iterateRoot(func(key string, op Op) bool {
+		ops[key] = op
+		return true
+	}, root)
+	return ops
+}
+
+// sameOps reports whether the maps hold the same operations.
+func sameOps(a, b map[string]Op) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, op := range a {
+		if other, ok := b[key]; !ok || !sameOp(op, other) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDumpLoadRoundTrip(t *testing.T) {
+	setClock(t)
+
+	for _, file := range []string{"dump.json", "dump.csv", "dump.txt"} {
+		// Case setup: binary-safe keys and values, a deletion, an expiring key
+		// and a transaction that is not committed.
+		source := NewRoot()
+		tx := source
+		for _, input := range [][]string{
+			{"WRITE", "text", "hello, \"world\"\nbye"},
+			{"WRITE", "binary", "\x00\xff\r\n"},
+			{"WRITE", "\xfekey", "value"},
+			{"WRITE", "empty", ""},
+			{"WRITE", "gone", "x"},
+			{"DELETE", "gone"},
+			{"WRITE", "session", "abc", "EX", "10"},
+			{"START"},
+			{"WRITE", "uncommitted", "x"},
+		} {
+			tx, _, _ = ExecuteOp(input[0], input[1:], tx)
+		}
+		path := filepath.Join(t.TempDir(), file)
+		if _, _, err := ExecuteOp("DUMP", []string{path}, tx); err != nil {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: %v.\n", file, err, nil)
+		}
+
+		target := NewRoot()
+		if _, _, err := ExecuteOp("LOAD", []string{path}, target); err != nil {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: %v.\n", file, err, nil)
+		}
+
+		// Are the committed operations, deletions included, loaded back unchanged?
+		actual, expected := rootOps(target), rootOps(source)
+		if !sameOps(actual, expected) {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: %v.\n", file, actual, expected)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	cases := []struct {
+		name    string
+		file    string
+		content string
+		inputs  [][]string
+		output  string
+		err     string
+	}{
+		{
+			name:    "json",
+			file:    "fixture.json",
+			content: `[{"key":"a","value":"hello"},{"key":"b","deleted":true},{"key":"Yw==","value":"AP8=","encoding":"base64"}]`,
+			inputs:  [][]string{{"WRITE", "b", "old"}, {"LOAD", "fixture.json"}, {"SCAN", "a", "d"}},
+			output:  "a hello\nc \x00\xff\n",
+		},
+		{
+			name:    "csv with a header",
+			file:    "fixture.csv",
+			content: "key,value,encoding,deleted,expires_at\na,\"hello, world\",,,\nb,,,true,\n",
+			inputs:  [][]string{{"LOAD", "fixture.csv"}, {"SCAN", "a", "c"}},
+			output:  "a hello, world\n",
+		},
+		{
+			name:    "format named explicitly",
+			file:    "fixture.txt",
+			content: "key,value,encoding,deleted,expires_at\na,hello,,false,\n",
+			inputs:  [][]string{{"LOAD", "fixture.txt", "csv"}, {"READ", "a"}},
+			output:  "hello\n",
+		},
+		{
+			name:    "load inside a transaction that is aborted",
+			file:    "fixture.json",
+			content: `[{"key":"a","value":"hello"}]`,
+			inputs:  [][]string{{"START"}, {"LOAD", "fixture.json"}, {"DIFF"}, {"ABORT"}, {"EXISTS", "a"}},
+			output:  "WRITE a hello\nnever set\n",
+		},
+		{
+			name:    "load inside a transaction that is committed",
+			file:    "fixture.json",
+			content: `[{"key":"a","value":"hello"}]`,
+			inputs:  [][]string{{"START"}, {"LOAD", "fixture.json"}, {"COMMIT"}, {"READ", "a"}},
+			output:  "hello\n",
+		},
+		{
+			name:    "bad record loads nothing",
+			file:    "fixture.json",
+			content: `[{"key":"a","value":"hello"},{"key":"b","value":"!","encoding":"base64"}]`,
+			inputs:  [][]string{{"LOAD", "fixture.json"}, {"EXISTS", "a"}},
+			output:  "never set\n",
+			err:     "ERROR: LOAD of fixture.json failed: record 2: key b is not base64.\n",
+		},
+		{
+			name:    "csv without a header",
+			file:    "fixture.csv",
+			content: "a,hello,,false,\n",
+			inputs:  [][]string{{"LOAD", "fixture.csv"}},
+			err:     "ERROR: LOAD of fixture.csv failed: the first row must be the header key,value,encoding,deleted,expires_at.\n",
+		},
+		{
+			name:   "unsupported format",
+			inputs: [][]string{{"DUMP", "dump.xml", "XML"}},
+			err:    "ERROR: DUMP format XML is not supported, use JSON or CSV.\n",
+		},
+		{
+			name:   "missing file name",
+			inputs: [][]string{{"LOAD"}},
+			err:    "ERROR: LOAD called without a file.\n",
+		},
+	}
+
+	for _, exp := range cases {
+		// Case setup: the fixture in the working directory.
+		dir := t.TempDir()
+		if exp.file != "" {
+			if err := os.WriteFile(filepath.Join(dir, exp.file), []byte(exp.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		wd, _ := os.Getwd()
+		if err := os.Chdir(dir); err != nil {
+			t.Fatal(err)
+		}
+
+		currentTx := NewRoot()
+		var output, errs string
+		for _, input := range exp.inputs {
+			var out string
+			var err error
+			currentTx, out, err = ExecuteOp(input[0], input[1:], currentTx)
+			output += out
+			if err != nil {
+				errs += err.Error()
+			}
+		}
+		os.Chdir(wd)
+
+		// Is the output correct?
+		if output != exp.output {
+			t.Fatalf("Failed %s.\nActual: %q.\nExpected: %q.\n", exp.name, output, exp.output)
+		}
+
+		// Is the error correct?
+		if errs != exp.err {
+			t.Fatalf("Failed %s.\nActual: %q.\nExpected: %q.\n", exp.name, errs, exp.err)
+		}
+	}
+}
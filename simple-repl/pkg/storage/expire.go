@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// now returns the current time. It's a variable so tests can control the clock.
+var now = time.Now
+
+// expired tells if the operation wrote a value whose time to live has passed.
+func (op Op) expired() bool {
+	return !op.Deleted && !op.ExpiresAt.IsZero() && !now().Before(op.ExpiresAt)
+}
+
+// parseExpiry parses the options following the value of WRITE. The only option
+// is EX <seconds>, the time to live of the key. Without options the key never expires.
+func parseExpiry(options []string) (time.Time, error) {
+	if len(options) == 0 {
+		return time.Time{}, nil
+	}
+	if strings.ToUpper(options[0]) != "EX" || len(options) != 2 {
+		return time.Time{}, fmt.Errorf("ERROR: WRITE option %s is not supported, use EX <seconds>.\n", strings.Join(options, " "))
+	}
+
+	seconds, err := strconv.ParseInt(options[1], 10, 64)
+	if err != nil || seconds <= 0 || seconds > math.MaxInt64/int64(time.Second) {
+		return time.Time{}, fmt.Errorf("ERROR: WRITE EX seconds %s must be a positive integer.\n", options[1])
+	}
+	return now().Add(time.Duration(seconds) * time.Second), nil
+}
+
+// ttlTx returns the number of seconds until the key expires, rounded up,
+// or -1 if the key never expires.
+func ttlTx(key string, currentTx Transaction) (string, error) {
+	op, keyExists := lookupTx(key, currentTx)
+	if !keyExists || op.Deleted || op.expired() {
+		return "", fmt.Errorf("Key not found: %s", key)
+	}
+	if op.ExpiresAt.IsZero() {
+		return "-1", nil
+	}
+
+	return strconv.FormatInt(remainingSeconds(op), 10), nil
+}
+
+// remainingSeconds returns the seconds the value written by the operation has
+// left to live, rounded up.
+func remainingSeconds(op Op) int64 {
+	remaining := op.ExpiresAt.Sub(now())
+	return int64((remaining + time.Second - 1) / time.Second)
+}
+
+// persistKeyTx removes the time to live of the key in the current transaction.
+func persistKeyTx(key string, currentTx Transaction) error {
+	op, keyExists := lookupTx(key, currentTx)
+	if !keyExists || op.Deleted || op.expired() {
+		return fmt.Errorf("Key not found: %s", key)
+	}
+	if op.ExpiresAt.IsZero() {
+		return nil
+	}
+	return putTx(key, Op{Value: op.Value}, currentTx)
+}
+
+// reclaimExpired replaces the expired keys of the root transaction with tombstones.
+// To every reader an expired key is the same as a deleted key, so unlike a commit
+// the keys don't get a new version and no transaction conflicts with the change.
+func reclaimExpired(keys []string, root Transaction) error {
+	ops := map[string]Op{}
+	for _, key := range keys {
+		if op, _ := getRoot(key, root); op.expired() {
+			ops[key] = tombstone
+		}
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+
+	if err := persist(ops, root); err != nil {
+		return err
+	}
+	return applyRoot(ops, root)
+}
+
+// SweepExpired reclaims every expired key of the root transaction.
+func SweepExpired(root Transaction) error {
+	keys := []string{}
+	iterateRoot(func(key string, op Op) bool {
+		if op.expired() {
+			keys = append(keys, key)
+		}
+		return true
+	}, root)
+	if err := root.db.takeErr(); err != nil {
+		return err
+	}
+	return reclaimExpired(keys, root)
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// setClock replaces the clock of the package with a fake clock for the test
+// and returns a function that moves the fake clock forward.
+func setClock(t *testing.T) func(d time.Duration) {
+	current := time.Unix(1000, 0)
+	now = func() time.Time { return current }
+	t.Cleanup(func() { now = time.Now })
+
+	return func(d time.Duration) {
+		current = current.Add(d)
+	}
+}
+
+func TestExpireTx(t *testing.T) {
+	cases := []struct {
+		name   string
+		inputs [][]string
+		output string
+		err    string
+	}{
+		{
+			name:   "time to live of a key",
+			inputs: [][]string{{"WRITE", "a", "hello", "EX", "10"}, {"WAIT", "3"}, {"TTL", "a"}},
+			output: "7\n",
+		},
+		{
+			name:   "time to live is rounded up",
+			inputs: [][]string{{"WRITE", "a", "hello", "EX", "10"}, {"WAIT", "0.5"}, {"TTL", "a"}},
+			output: "10\n",
+		},
+		{
+			name:   "time to live of a key that never expires",
+			inputs: [][]string{{"WRITE", "a", "hello"}, {"TTL", "a"}},
+			output: "-1\n",
+		},
+		{
+			name:   "read an expired key",
+			inputs: [][]string{{"WRITE", "a", "hello", "EX", "10"}, {"WAIT", "10"}, {"READ", "a"}},
+			output: "\n",
+			err:    "Key not found: a",
+		},
+		{
+			name:   "an expired key is deleted",
+			inputs: [][]string{{"WRITE", "a", "hello", "EX", "10"}, {"WAIT", "10"}, {"EXISTS", "a"}},
+			output: "deleted\n",
+		},
+		{
+			name:   "time to live of an expired key",
+			inputs: [][]string{{"WRITE", "a", "hello", "EX", "10"}, {"WAIT", "11"}, {"TTL", "a"}},
+			output: "\n",
+			err:    "Key not found: a",
+		},
+		{
+			name:   "an expired key is not scanned",
+			inputs: [][]string{{"WRITE", "a", "hello", "EX", "10"}, {"WRITE", "b", "world"}, {"WAIT", "10"}, {"KEYS"}},
+			output: "b\n",
+		},
+		{
+			name:   "writing the key again removes the time to live",
+			inputs: [][]string{{"WRITE", "a", "hello", "EX", "10"}, {"WRITE", "a", "hello-again"}, {"WAIT", "20"}, {"READ", "a"}},
+			output: "hello-again\n",
+		},
+		{
+			name:   "persist a key",
+			inputs: [][]string{{"WRITE", "a", "hello", "EX", "10"}, {"PERSIST", "a"}, {"WAIT", "20"}, {"READ", "a"}},
+			output: "hello\n",
+		},
+		{
+			name:   "persist a missing key",
+			inputs: [][]string{{"PERSIST", "a"}},
+			err:    "Key not found: a",
+		},
+		{
+			name:   "increment keeps the time to live",
+			inputs: [][]string{{"WRITE", "n", "5", "EX", "10"}, {"INCR", "n"}, {"WAIT", "10"}, {"READ", "n"}},
+			output: "\n",
+			err:    "Key not found: n",
+		},
+		{
+			name:   "increment an expired key",
+			inputs: [][]string{{"WRITE", "n", "5", "EX", "10"}, {"WAIT", "10"}, {"INCR", "n"}, {"TTL", "n"}},
+			output: "-1\n",
+		},
+		{
+			name:   "time to live set in a committed transaction",
+			inputs: [][]string{{"WRITE", "a", "hello"}, {"START"}, {"WRITE", "a", "hello", "EX", "10"}, {"COMMIT"}, {"WAIT", "10"}, {"READ", "a"}},
+			output: "\n",
+			err:    "Key not found: a",
+		},
+		{
+			name:   "time to live set in an aborted transaction",
+			inputs: [][]string{{"WRITE", "a", "hello"}, {"START"}, {"WRITE", "a", "hello", "EX", "10"}, {"ABORT"}, {"WAIT", "10"}, {"READ", "a"}},
+			output: "hello\n",
+		},
+		{
+			name:   "persist in an aborted transaction",
+			inputs: [][]string{{"WRITE", "a", "hello", "EX", "10"}, {"START"}, {"PERSIST", "a"}, {"ABORT"}, {"TTL", "a"}},
+			output: "10\n",
+		},
+		{
+			name:   "key expires inside a transaction",
+			inputs: [][]string{{"WRITE", "a", "hello", "EX", "10"}, {"START"}, {"WAIT", "10"}, {"READ", "a"}},
+			output: "\n",
+			err:    "Key not found: a",
+		},
+		{
+			name:   "write with a time to live that is not a number",
+			inputs: [][]string{{"WRITE", "a", "hello", "EX", "ten"}},
+			err:    "ERROR: WRITE EX seconds ten must be a positive integer.\n",
+		},
+		{
+			name:   "write with an unknown option",
+			inputs: [][]string{{"WRITE", "a", "hello", "PX", "10"}},
+			err:    "ERROR: WRITE option PX 10 is not supported, use EX <seconds>.\n",
+		},
+	}
+
+	for _, exp := range cases {
+		wait := setClock(t)
+		currentTx := NewRoot()
+		var output string
+		var err error
+		for _, input := range exp.inputs {
+			// WAIT moves the clock forward by the number of seconds.
+			if input[0] == "WAIT" {
+				seconds, _ := strconv.ParseFloat(input[1], 64)
+				wait(time.Duration(seconds * float64(time.Second)))
+				continue
+			}
+			currentTx, output, err = ExecuteOp(input[0], input[1:], currentTx)
+		}
+
+		// Is the correct output returned by the last command?
+		if output != exp.output {
+			t.Fatalf("Failed %s.\nActual: %q.\nExpected: %q.\n", exp.name, output, exp.output)
+		}
+
+		// Is the correct error returned by the last command?
+		var actualMsg string
+		if err != nil {
+			actualMsg = err.Error()
+		}
+		if actualMsg != exp.err {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: %v.\n", exp.name, actualMsg, exp.err)
+		}
+	}
+}
+
+func TestReclaimExpired(t *testing.T) {
+	wait := setClock(t)
+	dir := t.TempDir()
+	root, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ExecuteOp("WRITE", []string{"a", "hello", "EX", "10"}, root)
+	ExecuteOp("WRITE", []string{"b", "world", "EX", "20"}, root)
+	ExecuteOp("WRITE", []string{"c", "forever"}, root)
+	ExecuteOp("WRITE", []string{"d", "hello-again", "EX", "10"}, root)
+	wait(10 * time.Second)
+
+	// Is an expired key reclaimed when a command accesses it?
+	ExecuteOp("EXISTS", []string{"a"}, root)
+	if root.Operations["a"] != tombstone || root.Operations["d"].Deleted {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", root.Operations, "a reclaimed, d not reclaimed")
+	}
+
+	// Are the expired keys reclaimed by a sweep?
+	if err := SweepExpired(root); err != nil {
+		t.Fatal(err)
+	}
+	if root.Operations["d"] != tombstone || root.Operations["b"].Deleted || root.Operations["c"].Deleted {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", root.Operations, "d reclaimed, b and c not reclaimed")
+	}
+	root.disk.file.Close()
+
+	// Is the time to live of the remaining keys recovered from the log?
+	recovered, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.disk.file.Close()
+	expected := map[string]string{"a": "deleted", "b": "exists", "c": "exists", "d": "deleted"}
+	for key, exists := range expected {
+		if actualExists := existsTx(key, recovered); actualExists != exists {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: %v.\n", key, actualExists, exists)
+		}
+	}
+	wait(10 * time.Second)
+	if actualExists := existsTx("b", recovered); actualExists != "deleted" {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: deleted.\n", actualExists)
+	}
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// historySize is how many of the most recent operations committed
+// to the root transaction HISTORY can show.
+const historySize = 100
+
+// defaultHistoryCount is how many operations HISTORY shows without a count.
+const defaultHistoryCount = 10
+
+// historyEntry is an operation on a key committed to the root transaction.
+type historyEntry struct {
+	clock uint64
+	key   string
+	op    Op
+}
+
+// statusTx returns the nesting depth of the current transaction, 0 being the
+// root transaction, and the savepoint that started it, if any.
+func statusTx(currentTx Transaction) string {
+	depth := 0
+	for tx := &currentTx; tx.parent != nil; tx = tx.parent {
+		depth++
+	}
+
+	status := fmt.Sprintf("depth %d\n", depth)
+	if currentTx.name != "" {
+		status += fmt.Sprintf("savepoint %s\n", currentTx.name)
+	}
+	return status
+}
+
+// diffTx returns, sorted by key, the operations of the current transaction that
+// are not committed to its parent yet, one WRITE or DELETE command per line.
+func diffTx(currentTx Transaction) (string, error) {
+	if currentTx.parent == nil {
+		return "", errors.New("ERROR: DIFF called with no active transaction.\n")
+	}
+
+	keys := []string{}
+	for opKey := range currentTx.Operations {
+		keys = append(keys, opKey)
+	}
+	sort.Strings(keys)
+
+	var output strings.Builder
+	for _, key := range keys {
+		output.WriteString(formatOp(key, currentTx.Operations[key]) + "\n")
+	}
+	return output.String(), nil
+}
+
+// historyTx returns the most recent operations committed to the root transaction,
+// oldest first, each prefixed with the number of the commit it was part of.
+func historyTx(count string, currentTx Transaction) (string, error) {
+	n := defaultHistoryCount
+	if count != "" {
+		var err error
+		n, err = strconv.Atoi(count)
+		if err != nil || n <= 0 {
+			return "", fmt.Errorf("ERROR: HISTORY count %s must be a positive integer.\n", count)
+		}
+	}
+
+	var history []historyEntry
+	if currentTx.db != nil {
+		for _, entry := range currentTx.db.history {
+			if canRead(entry.key, currentTx) {
+				history = append(history, entry)
+			}
+		}
+	}
+	if len(history) > n {
+		history = history[len(history)-n:]
+	}
+
+	var output strings.Builder
+	for _, entry := range history {
+		output.WriteString(fmt.Sprintf("%d %s\n", entry.clock, formatOp(entry.key, entry.op)))
+	}
+	return output.String(), nil
+}
+
+// formatOp formats the operation on the key as the command that performs it now.
+// A write that expires is given the seconds it has left to live, and one that has
+// expired already is a deletion, which is what replaying it would amount to.
+func formatOp(key string, op Op) string {
+	if op.Deleted || op.expired() {
+		return "DELETE " + QuoteArg(key)
+	}
+
+	command := "WRITE " + QuoteArg(key) + " " + QuoteArg(op.Value)
+	if !op.ExpiresAt.IsZero() {
+		command += fmt.Sprintf(" EX %d", remainingSeconds(op))
+	}
+	return command
+}
+
+// QuoteArg quotes the argument, using the escape sequences the REPL understands,
+// when it would not be read back as the same single argument otherwise.
+func QuoteArg(arg string) string {
+	plain := arg != ""
+	for _, r := range arg {
+		if r == utf8.RuneError || r == '"' || r == '\\' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			plain = false
+		}
+	}
+	if plain {
+		return arg
+	}
+
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for i := 0; i < len(arg); {
+		r, size := utf8.DecodeRuneInString(arg[i:])
+		switch {
+		case r == '"' || r == '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteRune(r)
+		case r == '\n':
+			quoted.WriteString(`\n`)
+		case r == '\r':
+			quoted.WriteString(`\r`)
+		case r == '\t':
+			quoted.WriteString(`\t`)
+		case r == ' ' || (r != utf8.RuneError && unicode.IsPrint(r)):
+			quoted.WriteString(arg[i : i+size])
+		default:
+			for _, b := range []byte(arg[i : i+size]) {
+				fmt.Fprintf(&quoted, `\x%02x`, b)
+			}
+		}
+		i += size
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestIntrospection(t *testing.T) {
+	setClock(t)
+
+	cases := []struct {
+		name   string
+		inputs [][]string
+		output string
+		err    string
+	}{
+		{
+			name:   "status of the root transaction",
+			inputs: [][]string{{"STATUS"}},
+			output: "depth 0\n",
+		},
+		{
+			name:   "status of a nested savepoint",
+			inputs: [][]string{{"START"}, {"START"}, {"SAVEPOINT", "s1"}, {"STATUS"}},
+			output: "depth 3\nsavepoint s1\n",
+		},
+		{
+			name:   "status after commit",
+			inputs: [][]string{{"START"}, {"START"}, {"COMMIT"}, {"STATUS"}},
+			output: "depth 1\n",
+		},
+		{
+			name: "diff of the current transaction",
+			inputs: [][]string{
+				{"WRITE", "a", "hello"},
+				{"START"},
+				{"WRITE", "c", "hello world"},
+				{"DELETE", "a"},
+				{"WRITE", "b", "bye", "EX", "10"},
+				{"DIFF"},
+			},
+			output: "DELETE a\nWRITE b bye EX 10\nWRITE c \"hello world\"\n",
+		},
+		{
+			name:   "diff only shows the current transaction",
+			inputs: [][]string{{"START"}, {"WRITE", "a", "hello"}, {"START"}, {"WRITE", "b", "world"}, {"DIFF"}},
+			output: "WRITE b world\n",
+		},
+		{
+			name:   "diff of a committed child",
+			inputs: [][]string{{"START"}, {"WRITE", "a", "hello"}, {"START"}, {"WRITE", "b", "world"}, {"COMMIT"}, {"DIFF"}},
+			output: "WRITE a hello\nWRITE b world\n",
+		},
+		{
+			name:   "diff without a transaction",
+			inputs: [][]string{{"DIFF"}},
+			err:    "ERROR: DIFF called with no active transaction.\n",
+		},
+		{
+			name: "history of commits to the root transaction",
+			inputs: [][]string{
+				{"WRITE", "a", "hello"},
+				{"START"},
+				{"WRITE", "b", "2"},
+				{"DELETE", "a"},
+				{"COMMIT"},
+				{"START"},
+				{"WRITE", "c", "aborted"},
+				{"ABORT"},
+				{"START"},
+				{"WRITE", "d", "pending"},
+				{"HISTORY"},
+			},
+			output: "1 WRITE a hello\n2 DELETE a\n2 WRITE b 2\n",
+		},
+		{
+			name:   "history with a count",
+			inputs: [][]string{{"WRITE", "a", "1"}, {"WRITE", "b", "\n"}, {"WRITE", "c", "0x10"}, {"HISTORY", "2"}},
+			output: "2 WRITE b \"\\n\"\n3 WRITE c 0x10\n",
+		},
+		{
+			name:   "history with an invalid count",
+			inputs: [][]string{{"HISTORY", "0"}},
+			err:    "ERROR: HISTORY count 0 must be a positive integer.\n",
+		},
+	}
+
+	for _, exp := range cases {
+		currentTx := NewRoot()
+		var output string
+		var err error
+		for _, input := range exp.inputs {
+			currentTx, output, err = ExecuteOp(input[0], input[1:], currentTx)
+		}
+
+		// Is the correct output returned by the last command?
+		if output != exp.output {
+			t.Fatalf("Failed %s.\nActual: %q.\nExpected: %q.\n", exp.name, output, exp.output)
+		}
+
+		// Is the correct error returned by the last command?
+		var actualMsg string
+		if err != nil {
+			actualMsg = err.Error()
+		}
+		if actualMsg != exp.err {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: %v.\n", exp.name, actualMsg, exp.err)
+		}
+	}
+}
+
+func TestHistorySize(t *testing.T) {
+	root := NewRoot()
+	for i := 0; i < historySize+5; i++ {
+		writeTx(fmt.Sprintf("key-%d", i), "value", root)
+	}
+
+	// Is only the most recent history kept?
+	if len(root.db.history) != historySize || root.db.history[0].key != "key-5" {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v entries from key-5 on.\n", len(root.db.history), historySize)
+	}
+}
+
+func TestQuoteArg(t *testing.T) {
+	cases := []struct {
+		arg    string
+		quoted string
+	}{
+		{"hello", "hello"},
+		{"", `""`},
+		{"hello world", `"hello world"`},
+		{`say "hi"\`, `"say \"hi\"\\"`},
+		{"tab\tnew\nline\r", `"tab\tnew\nline\r"`},
+		{"0x10", "0x10"},
+		{`x"10"`, `"x\"10\""`},
+		{"snow☃", "snow☃"},
+		{"\x00\xff", `"\x00\xff"`},
+	}
+
+	for _, exp := range cases {
+		// Is the argument quoted only when needed?
+		if actual := QuoteArg(exp.arg); actual != exp.quoted {
+			t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", actual, exp.quoted)
+		}
+	}
+}
+
+func TestFormatOpExpiring(t *testing.T) {
+	advance := setClock(t)
+	root := NewRoot()
+	ExecuteOp("WRITE", []string{"b", "bye", "EX", "10"}, root)
+
+	cases := []struct {
+		name    string
+		elapsed time.Duration
+		output  string
+	}{
+		{"seconds left are rounded up", 3500 * time.Millisecond, "1 WRITE b bye EX 7\n"},
+		{"expired write", 10 * time.Second, "1 DELETE b\n"},
+	}
+
+	for _, exp := range cases {
+		advance(exp.elapsed)
+
+		// Is the write printed as a command that does the same when replayed now?
+		_, output, _ := ExecuteOp("HISTORY", nil, root)
+		if output != exp.output {
+			t.Fatalf("Failed %s.\nActual: %q.\nExpected: %q.\n", exp.name, output, exp.output)
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	segmentPrefix = "segment-"
+	segmentSuffix = ".sst"
+
+	// The footer of a segment holds the offset of the index, the number
+	// of keys and the CRC-32 checksum of the index.
+	segmentFooterSize = 16
+
+	// defaultFlushEvery is how many keys the memtable holds before it's written to
+	// a segment. defaultCompactEvery is how many segments there are before they
+	// are merged into one.
+	defaultFlushEvery   = 1000
+	defaultCompactEvery = 4
+)
+
+// lsmStore is a Store kept on disk as a log-structured merge tree.
+//
+// Operations are appended to a write-ahead log and applied to the memtable, an
+// in-memory table of the latest operations. Once the memtable holds flushEvery
+// keys it's written to a new segment, an immutable file of operations sorted by
+// key, and the log is truncated. Reads check the memtable and then the segments,
+// newest first. Once there are compactEvery segments they are merged into one.
+type lsmStore struct {
+	log      *disk
+	memtable map[string]Op
+
+	// segments are ordered oldest first.
+	segments []*segment
+
+	flushEvery   int
+	compactEvery int
+}
+
+// segment is an immutable file holding the operations on keys sorted by key,
+// followed by the index of the keys and the footer. Only the index is kept in
+// memory, the operations are read from the file.
+type segment struct {
+	file *os.File
+
+	// seq is the sequence number of the last log record the segment covers.
+	seq uint64
+
+	// offsets[i] is the offset in the file of the operation on keys[i]. The
+	// last offset is the end of the operations, i.e the start of the index.
+	keys    []string
+	offsets []int64
+}
+
+// OpenLSMStore returns the Store kept on disk in dir. The segments are opened and
+// the write-ahead log is replayed to rebuild the memtable. Like in Open, a torn or
+// corrupt record at the end of the log is truncated away.
+func OpenLSMStore(dir string) (Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &lsmStore{
+		memtable:     map[string]Op{},
+		flushEvery:   defaultFlushEvery,
+		compactEvery: defaultCompactEvery,
+	}
+
+	names, err := fileNames(dir, segmentPrefix, segmentSuffix)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		seg, err := openSegment(filepath.Join(dir, name))
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("segment %s: %v", name, err)
+		}
+		s.segments = append(s.segments, seg)
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.log = &disk{dir: dir, file: file}
+
+	// The records covered by the newest segment are skipped by the replay.
+	if len(s.segments) > 0 {
+		s.log.seq = s.segments[len(s.segments)-1].seq
+	}
+	err = s.log.replay(func(seq uint64, ops map[string]Op) {
+		for opKey, op := range ops {
+			s.memtable[opKey] = op
+		}
+	})
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *lsmStore) Get(key string) (Op, bool, error) {
+	if op, keyExists := s.memtable[key]; keyExists {
+		return op, true, nil
+	}
+	for i := len(s.segments) - 1; i >= 0; i-- {
+		op, keyExists, err := s.segments[i].get(key)
+		if err != nil || keyExists {
+			return op, keyExists, err
+		}
+	}
+	return Op{}, false, nil
+}
+
+func (s *lsmStore) Put(key string, op Op) error {
+	return s.Apply(map[string]Op{key: op})
+}
+
+func (s *lsmStore) Delete(key string) error {
+	return s.Apply(map[string]Op{key: tombstone})
+}
+
+func (s *lsmStore) Iterate(fn func(key string, op Op) bool) error {
+	for _, key := range s.keys() {
+		op, _, err := s.Get(key)
+		if err != nil {
+			return err
+		}
+		if !fn(key, op) {
+			break
+		}
+	}
+	return nil
+}
+
+// Apply appends the operations as one record to the write-ahead log, so they are
+// recovered all together or not at all, and then applies them to the memtable.
+func (s *lsmStore) Apply(ops map[string]Op) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	// Flush the memtable before it grows past the flush interval.
+	if len(s.memtable) >= s.flushEvery {
+		if err := s.flush(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.log.append(ops); err != nil {
+		return err
+	}
+	for opKey, op := range ops {
+		s.memtable[opKey] = op
+	}
+	return nil
+}
+
+func (s *lsmStore) Close() error {
+	var err error
+	if s.log != nil {
+		err = s.log.file.Close()
+	}
+	for _, seg := range s.segments {
+		if closeErr := seg.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// keys returns the sorted keys of the memtable and of every segment.
+func (s *lsmStore) keys() []string {
+	unique := map[string]struct{}{}
+	for key := range s.memtable {
+		unique[key] = struct{}{}
+	}
+	for _, seg := range s.segments {
+		for _, key := range seg.keys {
+			unique[key] = struct{}{}
+		}
+	}
+
+	keys := make([]string, 0, len(unique))
+	for key := range unique {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// flush writes the memtable to a new segment covering every record in the log,
+// then truncates the log. The segments are compacted once there are compactEvery.
+func (s *lsmStore) flush() error {
+	if len(s.memtable) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(s.memtable))
+	for key := range s.memtable {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	seg, err := s.writeSegment(s.log.seq, keys, func(key string) (Op, error) {
+		return s.memtable[key], nil
+	})
+	if err != nil {
+		return err
+	}
+	s.segments = append(s.segments, seg)
+	s.memtable = map[string]Op{}
+
+	if err := s.log.truncate(); err != nil {
+		return err
+	}
+	if len(s.segments) >= s.compactEvery {
+		return s.compact()
+	}
+	return nil
+}
+
+// compact merges every segment into one, keeping the newest operation on each key.
+// The merged segment replaces the newest segment, so until the older segments are
+// removed they are hidden behind it.
+func (s *lsmStore) compact() error {
+	newest := s.segments[len(s.segments)-1]
+
+	keys := map[string]struct{}{}
+	for _, seg := range s.segments {
+		for _, key := range seg.keys {
+			keys[key] = struct{}{}
+		}
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	merged, err := s.writeSegment(newest.seq, sorted, func(key string) (Op, error) {
+		for i := len(s.segments) - 1; i >= 0; i-- {
+			op, keyExists, err := s.segments[i].get(key)
+			if err != nil || keyExists {
+				return op, err
+			}
+		}
+		return Op{}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, seg := range s.segments {
+		seg.file.Close()
+		if seg != newest {
+			os.Remove(filepath.Join(s.log.dir, segmentName(seg.seq)))
+		}
+	}
+	s.segments = []*segment{merged}
+	return nil
+}
+
+// writeSegment writes the operations on the sorted keys to the segment covering
+// the log records up to seq. It's written to a temporary file first so a partially
+// written segment is never mistaken for a complete one.
+func (s *lsmStore) writeSegment(seq uint64, keys []string, get func(key string) (Op, error)) (*segment, error) {
+	path := filepath.Join(s.log.dir, segmentName(seq))
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	var offset int64
+	var index []byte
+	for _, key := range keys {
+		op, err := get(key)
+		if err != nil {
+			return nil, err
+		}
+		entry := appendOp(nil, key, op)
+		if _, err := writer.Write(entry); err != nil {
+			return nil, err
+		}
+		index = appendString(index, key)
+		index = binary.AppendUvarint(index, uint64(offset))
+		offset += int64(len(entry))
+	}
+
+	footer := make([]byte, segmentFooterSize)
+	binary.BigEndian.PutUint64(footer[0:8], uint64(offset))
+	binary.BigEndian.PutUint32(footer[8:12], uint32(len(keys)))
+	binary.BigEndian.PutUint32(footer[12:16], crc32.Checksum(index, crcTable))
+	writer.Write(index)
+	writer.Write(footer)
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	if err := file.Sync(); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return nil, err
+	}
+	if err := syncDir(s.log.dir); err != nil {
+		return nil, err
+	}
+	return openSegment(path)
+}
+
+// openSegment opens the segment file at path and reads its index.
+func openSegment(path string) (*segment, error) {
+	var seq uint64
+	if _, err := fmt.Sscanf(filepath.Base(path), segmentPrefix+"%d"+segmentSuffix, &seq); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	seg, err := readIndex(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	seg.seq = seq
+	return seg, nil
+}
+
+// readIndex reads the footer and the index of the segment file.
+func readIndex(file *os.File) (*segment, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size < segmentFooterSize {
+		return nil, errCorruptRecord
+	}
+
+	footer := make([]byte, segmentFooterSize)
+	if _, err := file.ReadAt(footer, size-segmentFooterSize); err != nil {
+		return nil, err
+	}
+	indexOffset := int64(binary.BigEndian.Uint64(footer[0:8]))
+	count := binary.BigEndian.Uint32(footer[8:12])
+	if indexOffset < 0 || indexOffset > size-segmentFooterSize {
+		return nil, errCorruptRecord
+	}
+
+	index := make([]byte, size-segmentFooterSize-indexOffset)
+	if _, err := file.ReadAt(index, indexOffset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if crc32.Checksum(index, crcTable) != binary.BigEndian.Uint32(footer[12:16]) {
+		return nil, errCorruptRecord
+	}
+
+	seg := &segment{file: file}
+	for i := uint32(0); i < count; i++ {
+		var key string
+		var offset uint64
+		key, index, err = readString(index)
+		if err == nil {
+			offset, index, err = readUvarint(index)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// The keys are sorted and their operations follow each other.
+		if int64(offset) >= indexOffset || (i > 0 && (key <= seg.keys[i-1] || int64(offset) <= seg.offsets[i-1])) {
+			return nil, errCorruptRecord
+		}
+		seg.keys = append(seg.keys, key)
+		seg.offsets = append(seg.offsets, int64(offset))
+	}
+	if len(index) != 0 {
+		return nil, errCorruptRecord
+	}
+	seg.offsets = append(seg.offsets, indexOffset)
+	return seg, nil
+}
+
+// get reads the operation on the key from the segment file.
+func (seg *segment) get(key string) (Op, bool, error) {
+	i := sort.SearchStrings(seg.keys, key)
+	if i == len(seg.keys) || seg.keys[i] != key {
+		return Op{}, false, nil
+	}
+
+	entry := make([]byte, seg.offsets[i+1]-seg.offsets[i])
+	if _, err := seg.file.ReadAt(entry, seg.offsets[i]); err != nil {
+		return Op{}, false, err
+	}
+	opKey, op, rest, err := readOp(entry)
+	if err != nil {
+		return Op{}, false, err
+	}
+	if opKey != key || len(rest) != 0 {
+		return Op{}, false, errCorruptRecord
+	}
+	return op, true, nil
+}
+
+// segmentName returns the file name of the segment covering the log records up to seq.
+// The sequence number is zero padded so the names sort in the order they were written.
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%s%020d%s", segmentPrefix, seq, segmentSuffix)
+}
@@ -7,47 +7,159 @@ import (
 
 // readTx reads the value stored at the key if it exists.
 func readTx(key string, currentTx Transaction) (string, error) {
+	op, keyExists := lookupTx(key, currentTx)
 
-	// Check if the key exists in the operations of the current transaction.
-	if opValue, keyExists := currentTx.Operations[key]; keyExists {
+	// The key has never been written, it has been deleted or it has expired.
+	if !keyExists || op.Deleted || op.expired() {
+		return "", fmt.Errorf("Key not found: %s", key)
+	}
+
+	return op.Value, nil
+}
+
+// existsTx tells if the key exists, has been deleted or has never been written.
+// An expired key is deleted.
+func existsTx(key string, currentTx Transaction) string {
+	op, keyExists := lookupTx(key, currentTx)
+
+	switch {
+	case !keyExists:
+		return "never set"
+	case op.Deleted || op.expired():
+		return "deleted"
+	}
+	return "exists"
+}
+
+// stack is the state shared by a transaction started from the root transaction
+// and every transaction nested in it.
+//
+// The key table holds, for every key written by any of the transactions, the
+// operation of the innermost transaction that wrote it. So a key is read in
+// constant time however deep the transactions are nested: from the table if a
+// transaction wrote it, otherwise from the root transaction.
+type stack struct {
+	root  Transaction
+	table map[string]Op
+}
+
+// undoEntry is the operation on a key in the key table, if it existed.
+type undoEntry struct {
+	op     Op
+	exists bool
+}
+
+// lookupTx returns the last operation on the key in the current transaction
+// or it's parent transactions. It returns false if the key has never been written.
+// The root transaction is read as of the snapshot the current transaction started with.
+func lookupTx(key string, currentTx Transaction) (Op, bool) {
 
-		// The key has been deleted if the value is a string's zero value.
-		if opValue == "" {
-			return "", fmt.Errorf("Key not found: %s", key)
+	// The root transaction keeps its operations in its store.
+	if currentTx.parent == nil {
+		return getRoot(key, currentTx)
+	}
+
+	// Check if the key exists in the operations of the current transaction,
+	// then in the key table shared with its parent transactions.
+	if op, keyExists := currentTx.Operations[key]; keyExists {
+		return op, true
+	}
+	if currentTx.stack != nil {
+		if op, keyExists := currentTx.stack.table[key]; keyExists {
+			return op, true
 		}
+	}
 
-		return opValue, nil
+	// No transaction wrote the key, read the version of the key that was committed
+	// when the transactions started, if it changed since then, or the root transaction.
+	if op, keyExists, found := currentTx.db.read(key, currentTx.snapshot); found {
+		return op, keyExists
 	}
+	return getRoot(key, rootTx(currentTx))
+}
 
-	// The key does not exist in current transaction so
-	// check if it exists in it's parent transaction.
-	if currentTx.parent != nil {
-		return readTx(key, *currentTx.parent)
+// markRead records that the current transaction read the key.
+func markRead(key string, currentTx Transaction) {
+	if currentTx.reads != nil {
+		currentTx.reads[key] = struct{}{}
 	}
+}
 
-	// The key does not exist in the current transaction and
-	// there is no parent transaction.
-	return "", fmt.Errorf("Key not found: %s", key)
+// markScanned records that the current transaction scanned the keys for which
+// match returns true. A key another transaction commits in that range conflicts,
+// even if it didn't exist when the range was scanned.
+func markScanned(match func(key string) bool, currentTx Transaction) {
+	if currentTx.scans != nil {
+		*currentTx.scans = append(*currentTx.scans, match)
+	}
 }
 
 // writeTx adds or updates a key/value in the current transactions operations.
-func writeTx(key, value string, currentTx Transaction) {
-	currentTx.Operations[key] = value
-	return
+func writeTx(key, value string, currentTx Transaction) error {
+	return putTx(key, Op{Value: value}, currentTx)
 }
 
 // deleteTx "deletes" a value from the current transaction.
-// A deletion is represented by a string's zero value.
-func deleteTx(key string, currentTx Transaction) {
-	currentTx.Operations[key] = ""
-	return
+// A deletion is represented by a tombstone, an operation marked as deleted,
+// so the deletion hides the key in the parent transactions once committed.
+func deleteTx(key string, currentTx Transaction) error {
+	return putTx(key, tombstone, currentTx)
+}
+
+// putTx records the operation on the key in the current transaction.
+// Operations on the root transaction are committed right away.
+func putTx(key string, op Op, currentTx Transaction) error {
+	if currentTx.parent == nil {
+		return commitRoot(map[string]Op{key: op}, currentTx)
+	}
+	currentTx.Operations[key] = op
+
+	if currentTx.stack != nil {
+		if _, written := currentTx.undo[key]; !written {
+			previous, exists := currentTx.stack.table[key]
+			currentTx.undo[key] = undoEntry{op: previous, exists: exists}
+		}
+		currentTx.stack.table[key] = op
+	}
+	return nil
+}
+
+// rootTx returns the root transaction, i.e the last transaction in the parent chain.
+func rootTx(currentTx Transaction) Transaction {
+	if currentTx.stack != nil {
+		return currentTx.stack.root
+	}
+	for currentTx.parent != nil {
+		currentTx = *currentTx.parent
+	}
+	return currentTx
 }
 
 // startTx creates a new child transaction where the currentTx is the parent.
+// A transaction started from the root transaction pins a snapshot of the root
+// transaction and starts a new stack, nested transactions read from the same
+// snapshot and share the stack of their parent.
 func startTx(currentTx Transaction) Transaction {
+	snapshot, txStack := currentTx.snapshot, currentTx.stack
+	if currentTx.parent == nil {
+		snapshot = currentTx.db.now()
+	}
+	if txStack == nil {
+		txStack = &stack{root: rootTx(currentTx), table: map[string]Op{}}
+	}
+	currentTx.db.pin(snapshot)
+
 	childTx := Transaction{
-		Operations: map[string]string{},
+		Operations: map[string]Op{},
 		parent:     &currentTx,
+		stack:      txStack,
+		undo:       map[string]undoEntry{},
+		db:         currentTx.db,
+		snapshot:   snapshot,
+		reads:      map[string]struct{}{},
+		scans:      &[]func(key string) bool{},
+		user:       currentTx.user,
+		accounts:   currentTx.accounts,
 	}
 	return childTx
 }
@@ -60,15 +172,63 @@ func commitTx(currentTx Transaction) (Transaction, error) {
 		return currentTx, errors.New("ERROR: COMMIT called with no active transaction.\n")
 	}
 
+	// Abort the transaction if another transaction committed a change to a key
+	// it read or wrote after it started.
+	if err := currentTx.db.validate(currentTx); err != nil {
+		return discardTx(currentTx), err
+	}
+
+	// Operations committed to the root transaction become visible to everyone.
+	if currentTx.parent.parent == nil {
+		if err := commitRoot(currentTx.Operations, *currentTx.parent); err != nil {
+			return currentTx, err
+		}
+		currentTx.db.unpin(currentTx.snapshot)
+		return *currentTx.parent, nil
+	}
+
 	// Copy all operations from the current transaction to the parent transaction.
+	// The key table already holds them. Aborting the parent must undo them too,
+	// so the parent takes over the undo entries of the keys it didn't write.
 	for opKey, opValue := range currentTx.Operations {
+		if _, written := currentTx.parent.undo[opKey]; !written && currentTx.parent.undo != nil {
+			currentTx.parent.undo[opKey] = currentTx.undo[opKey]
+		}
 		currentTx.parent.Operations[opKey] = opValue
 	}
 
+	// The parent transaction now depends on everything the current transaction read.
+	for key := range currentTx.reads {
+		markRead(key, *currentTx.parent)
+	}
+	if currentTx.scans != nil {
+		for _, match := range *currentTx.scans {
+			markScanned(match, *currentTx.parent)
+		}
+	}
+	currentTx.db.unpin(currentTx.snapshot)
+
 	// Return the parent as the current transaction.
 	return *currentTx.parent, nil
 }
 
+// commitRoot applies the operations to the root transaction. They are logged
+// first if the root transaction is durable. The commit gets a version number,
+// and is notified, only once the store holds it, so a failed commit leaves no
+// trace and can be retried.
+func commitRoot(ops map[string]Op, root Transaction) error {
+	if err := persist(ops, root); err != nil {
+		return err
+	}
+	first := root.db.firstVersions(ops, root)
+	if err := applyRoot(ops, root); err != nil {
+		return err
+	}
+	root.db.committed(ops, first)
+	root.db.notify(ops)
+	return nil
+}
+
 // abortTx discards all operations in the current transaction.
 func abortTx(currentTx Transaction) (Transaction, error) {
 
@@ -77,6 +237,118 @@ func abortTx(currentTx Transaction) (Transaction, error) {
 		return currentTx, errors.New("ERROR: ABORT called with no active transaction.\n")
 	}
 
-	// Set the parent as the current transaction causing all pending transactions to be discarded.
-	return *currentTx.parent, nil
+	return discardTx(currentTx), nil
+}
+
+// discardTx replays the undo log of the current transaction, which restores
+// the key table as it was when the transaction started, and returns the parent.
+func discardTx(currentTx Transaction) Transaction {
+	if currentTx.stack != nil {
+		for opKey, entry := range currentTx.undo {
+			if entry.exists {
+				currentTx.stack.table[opKey] = entry.op
+			} else {
+				delete(currentTx.stack.table, opKey)
+			}
+		}
+	}
+	currentTx.db.unpin(currentTx.snapshot)
+	return *currentTx.parent
+}
+
+// savepointTx starts a new child transaction named after the savepoint.
+func savepointTx(name string, currentTx Transaction) (Transaction, error) {
+	if name == "" {
+		return currentTx, errors.New("ERROR: SAVEPOINT called without a savepoint name.\n")
+	}
+
+	childTx := startTx(currentTx)
+	childTx.name = name
+	return childTx, nil
+}
+
+// rollbackToTx discards all operations since the savepoint was created. The
+// savepoint and the transactions started before it remain active.
+func rollbackToTx(name string, currentTx Transaction) (Transaction, error) {
+	depth, found := findSavepoint(name, currentTx)
+	if !found {
+		return currentTx, fmt.Errorf("ERROR: ROLLBACK TO called with unknown savepoint %s.\n", name)
+	}
+
+	// Abort every transaction up to and including the savepoint's transaction,
+	// then start over with a new, empty, transaction for the savepoint.
+	for i := 0; i <= depth; i++ {
+		currentTx, _ = abortTx(currentTx)
+	}
+	return savepointTx(name, currentTx)
+}
+
+// releaseTx commits every transaction up to and including the savepoint's
+// transaction to its parent, which removes the savepoint.
+func releaseTx(name string, currentTx Transaction) (Transaction, error) {
+	depth, found := findSavepoint(name, currentTx)
+	if !found {
+		return currentTx, fmt.Errorf("ERROR: RELEASE called with unknown savepoint %s.\n", name)
+	}
+
+	var err error
+	for i := 0; i <= depth && err == nil; i++ {
+		currentTx, err = commitTx(currentTx)
+	}
+	return currentTx, err
+}
+
+// findSavepoint returns how many parents away from the current transaction the
+// most recent transaction named after the savepoint is.
+func findSavepoint(name string, currentTx Transaction) (int, bool) {
+	depth := 0
+	for tx := &currentTx; tx.parent != nil; tx = tx.parent {
+		if tx.name == name {
+			return depth, true
+		}
+		depth++
+	}
+	return 0, false
+}
+
+// commitAllTx commits every transaction, one at a time, until the operations
+// reach the root transaction.
+func commitAllTx(currentTx Transaction) (Transaction, error) {
+	if currentTx.parent == nil {
+		return currentTx, errors.New("ERROR: COMMIT ALL called with no active transaction.\n")
+	}
+
+	var err error
+	for currentTx.parent != nil && err == nil {
+		currentTx, err = commitTx(currentTx)
+	}
+	return currentTx, err
+}
+
+// abortAllTx discards every transaction and returns the root transaction.
+func abortAllTx(currentTx Transaction) (Transaction, error) {
+	if currentTx.parent == nil {
+		return currentTx, errors.New("ERROR: ABORT ALL called with no active transaction.\n")
+	}
+
+	for currentTx.parent != nil {
+		currentTx, _ = abortTx(currentTx)
+	}
+	return currentTx, nil
+}
+
+// persist appends the operations to the write-ahead log when currentTx is a durable
+// root transaction. Operations on any other transaction are only kept in memory.
+func persist(ops map[string]Op, currentTx Transaction) error {
+	if currentTx.parent != nil || currentTx.disk == nil || len(ops) == 0 {
+		return nil
+	}
+
+	// Compact the log before it grows past the snapshot interval.
+	if currentTx.disk.records >= currentTx.disk.snapshotEvery {
+		if err := currentTx.disk.snapshot(currentTx.Operations); err != nil {
+			return err
+		}
+	}
+	return currentTx.disk.append(ops)
 }
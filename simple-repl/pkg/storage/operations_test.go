@@ -2,6 +2,7 @@ package storage
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
 	"testing"
 )
@@ -9,7 +10,7 @@ import (
 func TestReadTx(t *testing.T) {
 
 	// Case 1 setup: key exists in current transaction, but it has been deleted.
-	deletedOp := map[string]string{"b": ""}
+	deletedOp := map[string]Op{"b": tombstone}
 
 	currentTx1 := Transaction{
 		Operations: deletedOp,
@@ -17,7 +18,7 @@ func TestReadTx(t *testing.T) {
 
 	// Case 2 setup: key exists in the current transaction and it has not been deleted.
 	currentTx2 := currentTx1
-	currentTx2.Operations["a"] = "hello"
+	currentTx2.Operations["a"] = Op{Value: "hello"}
 
 	// Case 4 setup: key does not exists in current transaction nor in parent transaction.
 	currentTx3 := Transaction{
@@ -104,12 +105,12 @@ func TestWriteTx(t *testing.T) {
 
 	// Case 1 setup: add a new operation to a transaction.
 	currentTx1 := Transaction{
-		Operations: map[string]string{},
+		Operations: map[string]Op{},
 	}
 
 	// Case 2 setup: update an existing opertaion with a new value.
 	currentTx2 := Transaction{
-		Operations: map[string]string{"a": "hello"},
+		Operations: map[string]Op{"a": {Value: "hello"}},
 	}
 
 	cases := []struct {
@@ -137,7 +138,7 @@ func TestWriteTx(t *testing.T) {
 		writeTx(exp.key, exp.value, exp.currentTx)
 
 		// Does the correct value get written?
-		if exp.currentTx.Operations[exp.key] != exp.value {
+		if exp.currentTx.Operations[exp.key] != (Op{Value: exp.value}) {
 			t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n",
 				exp.currentTx.Operations[exp.key],
 				exp.value,
@@ -150,13 +151,13 @@ func TestDeleteTx(t *testing.T) {
 
 	// Case 1 Setup: there are no operations in the current transaction.
 	currentTx1 := Transaction{
-		Operations: map[string]string{},
+		Operations: map[string]Op{},
 	}
 
 	// Case 2 Setup: there are is an operation in the current transaction with a
 	// matching key that is to be delted.
 	currentTx2 := Transaction{
-		Operations: map[string]string{"a": "hello"},
+		Operations: map[string]Op{"a": {Value: "hello"}},
 	}
 
 	cases := []struct {
@@ -202,11 +203,11 @@ func TestDeleteTx(t *testing.T) {
 		}
 
 		// Is the delete operation recorded correctly?
-		// i.e. the value of the deleted key is a string's zero value.
-		if exp.currentTx.Operations[exp.key] != "" {
+		// i.e. the deleted key holds a tombstone.
+		if exp.currentTx.Operations[exp.key] != tombstone {
 			t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n",
 				exp.currentTx.Operations[exp.key],
-				"",
+				tombstone,
 			)
 		}
 	}
@@ -214,7 +215,7 @@ func TestDeleteTx(t *testing.T) {
 
 func TestStartTx(t *testing.T) {
 	root := Transaction{
-		Operations: map[string]string{"a": "hello"},
+		Operations: map[string]Op{"a": {Value: "hello"}},
 	}
 
 	cases := []struct {
@@ -354,3 +355,443 @@ func TestAbortTxs(t *testing.T) {
 		}
 	}
 }
+
+func TestCommitTxConflict(t *testing.T) {
+	conflictErr := "ERROR: COMMIT conflict, a was changed by another transaction. The transaction was aborted.\n"
+
+	cases := []struct {
+		name string
+
+		// run executes the operations of the transaction under test, tx,
+		// and of a concurrent transaction, other, on the same root.
+		run func(root Transaction) (Transaction, Transaction)
+		err string
+	}{
+		{
+			name: "read key changed by a concurrent commit",
+			run: func(root Transaction) (Transaction, Transaction) {
+				tx := startTx(root)
+				markRead("a", tx)
+				other := startTx(root)
+				writeTx("a", "other", other)
+				commitTx(other)
+				writeTx("b", "mine", tx)
+				return root, tx
+			},
+			err: conflictErr,
+		},
+		{
+			name: "written key changed by a root write",
+			run: func(root Transaction) (Transaction, Transaction) {
+				tx := startTx(root)
+				writeTx("a", "mine", tx)
+				writeTx("a", "other", root)
+				return root, tx
+			},
+			err: conflictErr,
+		},
+		{
+			name: "read of a nested transaction committed to the parent",
+			run: func(root Transaction) (Transaction, Transaction) {
+				tx := startTx(root)
+				child := startTx(tx)
+				markRead("a", child)
+				tx, _ = commitTx(child)
+				writeTx("a", "other", root)
+				return root, tx
+			},
+			err: conflictErr,
+		},
+		{
+			name: "unrelated key changed by a concurrent commit",
+			run: func(root Transaction) (Transaction, Transaction) {
+				tx := startTx(root)
+				markRead("a", tx)
+				writeTx("a", "mine", tx)
+				writeTx("b", "other", root)
+				return root, tx
+			},
+			err: "",
+		},
+		{
+			name: "key changed before the transaction started",
+			run: func(root Transaction) (Transaction, Transaction) {
+				writeTx("a", "other", root)
+				tx := startTx(root)
+				markRead("a", tx)
+				writeTx("a", "mine", tx)
+				return root, tx
+			},
+			err: "",
+		},
+	}
+
+	for _, exp := range cases {
+		root, tx := exp.run(NewRoot())
+		actualTx, actualErr := commitTx(tx)
+
+		// Is the correct error returned?
+		var actualMsg string
+		if actualErr != nil {
+			actualMsg = actualErr.Error()
+		}
+		if actualMsg != exp.err {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: %v.\n", exp.name, actualMsg, exp.err)
+		}
+
+		// Is the transaction finished, committed or aborted, in both cases?
+		if actualTx.parent != nil {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: root.\n", exp.name, actualTx)
+		}
+
+		// Are the operations of a conflicting transaction discarded?
+		if exp.err != "" && root.Operations["b"].Value == "mine" {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: b not committed.\n", exp.name, root.Operations)
+		}
+	}
+}
+
+func TestReadTxSnapshot(t *testing.T) {
+	root := NewRoot()
+	writeTx("a", "hello", root)
+	writeTx("b", "world", root)
+
+	// Setup: a transaction and its nested transaction started before
+	// another transaction commits changes to a and b.
+	tx := startTx(root)
+	nested := startTx(tx)
+	other := startTx(root)
+	writeTx("a", "hello-again", other)
+	deleteTx("b", other)
+	commitTx(other)
+	later := startTx(root)
+
+	cases := []struct {
+		name      string
+		key       string
+		output    string
+		currentTx Transaction
+	}{
+		{"transaction reads its snapshot", "a", "hello", tx},
+		{"transaction reads deleted key", "b", "world", tx},
+		{"nested transaction reads its parent's snapshot", "a", "hello", nested},
+		{"root reads the latest value", "a", "hello-again", root},
+		{"root reads the latest deletion", "b", "", root},
+		{"later transaction reads the latest value", "a", "hello-again", later},
+		{"later transaction reads the latest deletion", "b", "", later},
+	}
+
+	for _, exp := range cases {
+		actualOutput, _ := readTx(exp.key, exp.currentTx)
+
+		// Is the value of the key as of the snapshot read?
+		if actualOutput != exp.output {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: %v.\n", exp.name, actualOutput, exp.output)
+		}
+	}
+
+	// Are the old versions kept while a snapshot can see them?
+	if len(root.db.versions) != 2 {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: versions of a and b.\n", root.db.versions)
+	}
+
+	// Are the old versions garbage-collected once no open transaction can see them?
+	abortTx(nested)
+	abortTx(tx)
+	if len(root.db.versions) != 0 || len(root.db.modified) != 0 {
+		t.Fatalf("Failed.\nActual: %v, %v.\nExpected: no versions.\n", root.db.versions, root.db.modified)
+	}
+	abortTx(later)
+	if len(root.db.pinned) != 0 {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: no pinned snapshots.\n", root.db.pinned)
+	}
+}
+
+func TestExistsTx(t *testing.T) {
+	root := NewRoot()
+	writeTx("empty", "", root)
+	writeTx("a", "hello", root)
+	writeTx("b", "world", root)
+	deleteTx("b", root)
+
+	// Setup: a transaction deletes a, but it is aborted.
+	aborted := startTx(root)
+	deleteTx("a", aborted)
+	abortTx(aborted)
+
+	// Setup: a transaction deletes the empty value, but it is not committed yet.
+	pending := startTx(root)
+	deleteTx("empty", pending)
+
+	cases := []struct {
+		name      string
+		key       string
+		exists    string
+		output    string
+		err       error
+		currentTx Transaction
+	}{
+		{"empty value", "empty", "exists", "", nil, root},
+		{"value", "a", "exists", "hello", nil, root},
+		{"deleted", "b", "deleted", "", errors.New("Key not found: b"), root},
+		{"never set", "c", "never set", "", errors.New("Key not found: c"), root},
+		{"pending delete", "empty", "deleted", "", errors.New("Key not found: empty"), pending},
+		{"deleted in parent", "b", "deleted", "", errors.New("Key not found: b"), pending},
+		{"never set in parent", "c", "never set", "", errors.New("Key not found: c"), pending},
+	}
+
+	for _, exp := range cases {
+		actualExists := existsTx(exp.key, exp.currentTx)
+		actualOutput, actualErr := readTx(exp.key, exp.currentTx)
+
+		// Is a deleted key told apart from one that was never set?
+		if actualExists != exp.exists {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: %v.\n", exp.name, actualExists, exp.exists)
+		}
+
+		// Is the correct value read?
+		if actualOutput != exp.output {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: %v.\n", exp.name, actualOutput, exp.output)
+		}
+
+		// Is the correct error returned?
+		if fmt.Sprint(actualErr) != fmt.Sprint(exp.err) {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: %v.\n", exp.name, actualErr, exp.err)
+		}
+	}
+
+	// Does the tombstone hide the key in the root transaction once committed?
+	commitTx(pending)
+	if actualExists := existsTx("empty", root); actualExists != "deleted" {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", actualExists, "deleted")
+	}
+}
+
+func TestSavepoints(t *testing.T) {
+	cases := []struct {
+		name   string
+		inputs [][3]string
+		depth  int
+		values map[string]string
+		err    string
+	}{
+		{
+			name: "rollback to savepoint keeps earlier work",
+			inputs: [][3]string{
+				{"START", "", ""},
+				{"WRITE", "a", "1"},
+				{"SAVEPOINT", "s1", ""},
+				{"WRITE", "b", "2"},
+				{"START", "", ""},
+				{"WRITE", "c", "3"},
+				{"ROLLBACK", "TO", "s1"},
+			},
+			depth:  2,
+			values: map[string]string{"a": "1", "b": "", "c": ""},
+		},
+		{
+			name: "savepoint stays active after rollback",
+			inputs: [][3]string{
+				{"SAVEPOINT", "s1", ""},
+				{"WRITE", "a", "1"},
+				{"ROLLBACK", "TO", "s1"},
+				{"WRITE", "b", "2"},
+				{"ROLLBACK", "TO", "s1"},
+			},
+			depth:  1,
+			values: map[string]string{"a": "", "b": ""},
+		},
+		{
+			name: "release keeps the work of the savepoint",
+			inputs: [][3]string{
+				{"START", "", ""},
+				{"SAVEPOINT", "s1", ""},
+				{"WRITE", "a", "1"},
+				{"SAVEPOINT", "s2", ""},
+				{"WRITE", "b", "2"},
+				{"RELEASE", "s1", ""},
+			},
+			depth:  1,
+			values: map[string]string{"a": "1", "b": "2"},
+		},
+		{
+			name: "unknown savepoint",
+			inputs: [][3]string{
+				{"SAVEPOINT", "s1", ""},
+				{"ROLLBACK", "TO", "s2"},
+			},
+			depth: 1,
+			err:   "ERROR: ROLLBACK TO called with unknown savepoint s2.\n",
+		},
+		{
+			name: "unknown savepoint on release",
+			inputs: [][3]string{
+				{"RELEASE", "s1", ""},
+			},
+			depth: 0,
+			err:   "ERROR: RELEASE called with unknown savepoint s1.\n",
+		},
+		{
+			name: "commit all",
+			inputs: [][3]string{
+				{"START", "", ""},
+				{"WRITE", "a", "1"},
+				{"SAVEPOINT", "s1", ""},
+				{"START", "", ""},
+				{"WRITE", "b", "2"},
+				{"COMMIT", "ALL", ""},
+			},
+			depth:  0,
+			values: map[string]string{"a": "1", "b": "2"},
+		},
+		{
+			name: "abort all",
+			inputs: [][3]string{
+				{"START", "", ""},
+				{"WRITE", "a", "1"},
+				{"START", "", ""},
+				{"WRITE", "b", "2"},
+				{"ABORT", "ALL", ""},
+			},
+			depth:  0,
+			values: map[string]string{"a": "", "b": ""},
+		},
+		{
+			name: "abort all without a transaction",
+			inputs: [][3]string{
+				{"ABORT", "ALL", ""},
+			},
+			depth: 0,
+			err:   "ERROR: ABORT ALL called with no active transaction.\n",
+		},
+	}
+
+	for _, exp := range cases {
+		currentTx := NewRoot()
+		var err error
+		for _, input := range exp.inputs {
+			currentTx, _, err = ExecuteOp(input[0], input[1:], currentTx)
+		}
+
+		// Is the correct error returned by the last command?
+		var actualMsg string
+		if err != nil {
+			actualMsg = err.Error()
+		}
+		if actualMsg != exp.err {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: %v.\n", exp.name, actualMsg, exp.err)
+		}
+
+		// Is the correct transaction active?
+		depth := 0
+		for tx := &currentTx; tx.parent != nil; tx = tx.parent {
+			depth++
+		}
+		if depth != exp.depth {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: %v.\n", exp.name, depth, exp.depth)
+		}
+
+		// Are the correct values visible?
+		for key, value := range exp.values {
+			actualOutput, _ := readTx(key, currentTx)
+			if actualOutput != value {
+				t.Fatalf("Failed %s.\nActual: %v.\nExpected: %v.\n", exp.name, actualOutput, value)
+			}
+		}
+	}
+}
+
+func TestUndoLog(t *testing.T) {
+	cases := []struct {
+		name   string
+		inputs [][]string
+		output string
+	}{
+		{
+			name:   "abort restores the parent's write",
+			inputs: [][]string{{"WRITE", "a", "root"}, {"START"}, {"WRITE", "a", "1"}, {"START"}, {"WRITE", "a", "2"}, {"ABORT"}, {"READ", "a"}},
+			output: "1\n",
+		},
+		{
+			name:   "abort restores a deleted key",
+			inputs: [][]string{{"WRITE", "a", "root"}, {"START"}, {"START"}, {"DELETE", "a"}, {"ABORT"}, {"READ", "a"}},
+			output: "root\n",
+		},
+		{
+			name:   "abort of the parent undoes a committed child",
+			inputs: [][]string{{"WRITE", "a", "root"}, {"START"}, {"START"}, {"WRITE", "a", "2"}, {"WRITE", "b", "2"}, {"COMMIT"}, {"READ", "a"}, {"ABORT"}, {"READ", "a"}, {"EXISTS", "b"}},
+			output: "2\nroot\nnever set\n",
+		},
+		{
+			name:   "abort of the parent after the child overwrote its write",
+			inputs: [][]string{{"WRITE", "a", "root"}, {"START"}, {"WRITE", "a", "1"}, {"START"}, {"WRITE", "a", "2"}, {"COMMIT"}, {"ABORT"}, {"READ", "a"}},
+			output: "root\n",
+		},
+		{
+			name:   "rollback to a savepoint below nested transactions",
+			inputs: [][]string{{"START"}, {"WRITE", "a", "1"}, {"SAVEPOINT", "s1"}, {"WRITE", "a", "2"}, {"START"}, {"WRITE", "a", "3"}, {"ROLLBACK", "TO", "s1"}, {"READ", "a"}},
+			output: "1\n",
+		},
+		{
+			name:   "a new transaction starts with an empty key table",
+			inputs: [][]string{{"START"}, {"WRITE", "a", "1"}, {"ABORT"}, {"START"}, {"EXISTS", "a"}},
+			output: "never set\n",
+		},
+	}
+
+	for _, exp := range cases {
+		currentTx := NewRoot()
+		var output string
+		for _, input := range exp.inputs {
+			var out string
+			currentTx, out, _ = ExecuteOp(input[0], input[1:], currentTx)
+			output += out
+		}
+
+		// Is the key table restored by the undo logs?
+		if output != exp.output {
+			t.Fatalf("Failed %s.\nActual: %q.\nExpected: %q.\n", exp.name, output, exp.output)
+		}
+	}
+}
+
+// nestedTx returns the innermost of depth nested transactions started from a root
+// transaction holding the key "root". Every transaction writes a key of its own.
+func nestedTx(depth int) Transaction {
+	currentTx := NewRoot()
+	writeTx("root", "hello", currentTx)
+	for i := 0; i < depth; i++ {
+		currentTx = startTx(currentTx)
+		writeTx(fmt.Sprintf("level-%d", i), "hello", currentTx)
+	}
+	return currentTx
+}
+
+func BenchmarkReadTx(b *testing.B) {
+	for _, depth := range []int{1, 1000} {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			currentTx := nestedTx(depth)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := readTx("root", currentTx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAbortTx(b *testing.B) {
+	for _, depth := range []int{1, 1000} {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			currentTx := nestedTx(depth)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				childTx := startTx(currentTx)
+				writeTx("root", "bye", childTx)
+				writeTx("level-0", "bye", childTx)
+				abortTx(childTx)
+			}
+		})
+	}
+}
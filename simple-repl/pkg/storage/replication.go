@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// replicationQueueSize is how many bytes of commits are queued for a replica
+// before it's dropped for falling behind. It's a variable so the tests can
+// lower it.
+var replicationQueueSize = 64 * 1024 * 1024
+
+// errReplicaBehind is returned by Send when the replica can't keep up with the commits.
+var errReplicaBehind = errors.New("the replica fell behind the primary")
+
+// Replication streams the commits of a root transaction to a replica.
+//
+// The stream starts with a snapshot of the root transaction, numbered 1 and
+// written like a snapshot file, see writeSnapshot, followed by every commit
+// made after it in commit order. Each commit is encoded like a write-ahead log
+// record, numbered from 2, so a replica can check that it applies all of them.
+type Replication struct {
+	snapshot map[string]Op
+
+	// mu guards records, which are queued by the commits and written to
+	// the replica by Send. queued is the size in bytes of the records, once
+	// it would grow past replicationQueueSize the replica is behind and the
+	// commits are not queued anymore.
+	mu      sync.Mutex
+	records [][]byte
+	queued  int
+	behind  bool
+	seq     uint64
+
+	ready   chan struct{}
+	stopped chan struct{}
+	stop    func()
+}
+
+// StartReplication takes a snapshot of the root transaction of currentTx and
+// starts queuing its commits. Like ExecuteOp it must be called, and Stop too,
+// while holding the lock that serializes the commands on the root transaction.
+func StartReplication(currentTx Transaction) (*Replication, error) {
+	root := rootTx(currentTx)
+	r := &Replication{
+		ready:   make(chan struct{}, 1),
+		stopped: make(chan struct{}),
+	}
+
+	snapshot := map[string]Op{}
+	iterateRoot(func(key string, op Op) bool {
+		snapshot[key] = op
+		return true
+	}, root)
+	if err := root.db.takeErr(); err != nil {
+		return nil, err
+	}
+
+	r.snapshot, r.seq = snapshot, 1
+	r.stop = watchCommits(root, func(commit uint64, ops map[string]Op) {
+		r.queue(ops)
+	})
+	return r, nil
+}
+
+// queue encodes the operations as the next record of the stream. A commit that
+// doesn't fit in a record, or in the queue, puts the replica behind: it has to
+// start over from a new snapshot.
+func (r *Replication) queue(ops map[string]Op) {
+	r.mu.Lock()
+	if r.behind {
+		r.mu.Unlock()
+		return
+	}
+	r.seq++
+	record := encodeRecord(r.seq, ops)
+	if len(record)-recordHeaderSize > maxRecordSize || (r.queued > 0 && r.queued+len(record) > replicationQueueSize) {
+		r.records, r.queued, r.behind = nil, 0, true
+	} else {
+		r.records = append(r.records, record)
+		r.queued += len(record)
+	}
+	r.mu.Unlock()
+
+	select {
+	case r.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Send writes the stream to the replica until writing fails, the replica falls
+// behind or the replication is stopped.
+func (r *Replication) Send(w io.Writer) error {
+	snapshot := r.snapshot
+	r.snapshot = nil
+	if err := writeSnapshot(w, 1, snapshot); err != nil {
+		return err
+	}
+
+	for {
+		r.mu.Lock()
+		records, behind := r.records, r.behind
+		r.records, r.queued = nil, 0
+		r.mu.Unlock()
+		if behind {
+			return errReplicaBehind
+		}
+
+		for _, record := range records {
+			if _, err := w.Write(record); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-r.stopped:
+			return nil
+		case <-r.ready:
+		}
+	}
+}
+
+// Stop stops queuing the commits and ends Send. It's safe to call more than once.
+func (r *Replication) Stop() {
+	select {
+	case <-r.stopped:
+		return
+	default:
+	}
+	r.stop()
+	close(r.stopped)
+}
+
+// Follow applies the replication stream read from the primary to the root
+// transaction of currentTx, until the stream ends or fails. The snapshot that
+// starts the stream replaces the operations of the root transaction, so the
+// keys the primary doesn't have are deleted. The lock that serializes the
+// commands on the root transaction is held while each record is applied.
+func Follow(stream io.Reader, currentTx Transaction, lock sync.Locker) error {
+	reader := bufio.NewReader(stream)
+	root := rootTx(currentTx)
+
+	seq, snapshot, err := readSnapshot(reader)
+	if err == io.EOF {
+		return errors.New("the primary closed the replication stream")
+	}
+	if err != nil {
+		return err
+	}
+	if seq != 1 {
+		return fmt.Errorf("replication record %d received, expected %d", seq, 1)
+	}
+
+	// The changes are committed in chunks, so each of them fits in a
+	// record of the write-ahead log of a durable replica.
+	lock.Lock()
+	for _, chunk := range chunkOps(snapshotChanges(snapshot, root)) {
+		if err = commitRoot(chunk, root); err != nil {
+			break
+		}
+	}
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for seq := uint64(2); ; seq++ {
+		recordSeq, ops, _, err := readRecord(reader)
+		if err == io.EOF {
+			return errors.New("the primary closed the replication stream")
+		}
+		if err != nil {
+			return err
+		}
+		if recordSeq != seq {
+			return fmt.Errorf("replication record %d received, expected %d", recordSeq, seq)
+		}
+
+		lock.Lock()
+		if len(ops) > 0 {
+			err = commitRoot(ops, root)
+		}
+		lock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// snapshotChanges returns the operations that make the root transaction
+// hold the operations of the snapshot.
+func snapshotChanges(snapshot map[string]Op, root Transaction) map[string]Op {
+	changes := map[string]Op{}
+	iterateRoot(func(key string, op Op) bool {
+		if _, inSnapshot := snapshot[key]; !inSnapshot && !op.Deleted {
+			changes[key] = tombstone
+		}
+		return true
+	}, root)
+
+	for key, op := range snapshot {
+		if rootOp, exists := getRoot(key, root); !exists || !sameOp(rootOp, op) {
+			changes[key] = op
+		}
+	}
+	return changes
+}
+
+// sameOp reports whether the operations are equal.
+func sameOp(a, b Op) bool {
+	return a.Value == b.Value && a.Deleted == b.Deleted && a.ExpiresAt.Equal(b.ExpiresAt)
+}
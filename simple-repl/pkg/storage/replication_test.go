@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReplication(t *testing.T) {
+	// Setup: a primary with committed keys and a replica holding stale keys.
+	var primaryMu, replicaMu sync.Mutex
+	primary, replica := NewRoot(), NewRoot()
+	for _, input := range [][]string{{"WRITE", "a", "1"}, {"WRITE", "b", "2"}, {"DELETE", "b"}} {
+		ExecuteOp(input[0], input[1:], primary)
+	}
+	for _, input := range [][]string{{"WRITE", "a", "old"}, {"WRITE", "stale", "x"}} {
+		ExecuteOp(input[0], input[1:], replica)
+	}
+
+	primaryMu.Lock()
+	replication, err := StartReplication(primary)
+	primaryMu.Unlock()
+	if err != nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", err, nil)
+	}
+	reader, writer := io.Pipe()
+	go replication.Send(writer)
+	followed := make(chan error, 1)
+	go func() {
+		followed <- Follow(reader, replica, &replicaMu)
+	}()
+
+	// Setup: commits made on the primary after the replication started.
+	primaryMu.Lock()
+	tx := primary
+	for _, input := range [][]string{{"START"}, {"WRITE", "c", "3"}, {"INCR", "a"}, {"COMMIT"}, {"WRITE", "d", "\x00binary"}} {
+		tx, _, _ = ExecuteOp(input[0], input[1:], tx)
+	}
+	primaryMu.Unlock()
+
+	expected := map[string]string{"a": "2", "b": "", "c": "3", "d": "\x00binary", "stale": ""}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		actual := map[string]string{}
+		replicaMu.Lock()
+		for key := range expected {
+			actual[key], _ = readTx(key, replica)
+		}
+		replicaMu.Unlock()
+
+		// Does the replica converge to the primary, in commit order?
+		if equalValues(actual, expected) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Failed.\nActual: %q.\nExpected: %q.\n", actual, expected)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Is the deleted key a tombstone on the replica too?
+	replicaMu.Lock()
+	existsB := existsTx("b", replica)
+	replicaMu.Unlock()
+	if existsB != "deleted" {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", existsB, "deleted")
+	}
+
+	// Does the replica stop following when the stream ends?
+	primaryMu.Lock()
+	replication.Stop()
+	replication.Stop()
+	primaryMu.Unlock()
+	writer.Close()
+	if err := <-followed; err == nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: an error.\n", err)
+	}
+}
+
+func TestFollowOutOfOrder(t *testing.T) {
+	reader, writer := io.Pipe()
+	go func() {
+		writeSnapshot(writer, 1, map[string]Op{"a": {Value: "1"}})
+		writer.Write(encodeRecord(3, map[string]Op{"a": {Value: "3"}}))
+		writer.Close()
+	}()
+
+	// Is a stream with a missing record rejected?
+	var mu sync.Mutex
+	err := Follow(reader, NewRoot(), &mu)
+	expected := "replication record 3 received, expected 2"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", err, expected)
+	}
+}
+
+// equalValues reports whether the maps hold the same values.
+func equalValues(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if b[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReplicationOfLargeSnapshot(t *testing.T) {
+	// Setup: a primary holding more than fits in one record.
+	var primaryMu, replicaMu sync.Mutex
+	primary, replica := NewRoot(), NewRoot()
+	value := strings.Repeat("x", 1024*1024)
+	for i := 0; i < 70; i++ {
+		writeTx(fmt.Sprintf("key-%d", i), value, primary)
+	}
+
+	replication, err := StartReplication(primary)
+	if err != nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", err, nil)
+	}
+	reader, writer := io.Pipe()
+	go replication.Send(writer)
+	followed := make(chan error, 1)
+	go func() {
+		followed <- Follow(reader, replica, &replicaMu)
+	}()
+
+	// Is the whole snapshot applied to the replica?
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		replicaMu.Lock()
+		actualOutput, _ := readTx("key-69", replica)
+		replicaMu.Unlock()
+		if actualOutput == value {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Failed.\nActual: %d bytes.\nExpected: %d bytes.\n", len(actualOutput), len(value))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	replicaMu.Lock()
+	count := len(rootOps(replica))
+	replicaMu.Unlock()
+	if count != 70 {
+		t.Fatalf("Failed.\nActual: %v keys.\nExpected: 70 keys.\n", count)
+	}
+
+	primaryMu.Lock()
+	replication.Stop()
+	primaryMu.Unlock()
+	writer.Close()
+	<-followed
+}
+
+func TestReplicaFallsBehind(t *testing.T) {
+	defer func(size int) { replicationQueueSize = size }(replicationQueueSize)
+	replicationQueueSize = 100
+
+	primary := NewRoot()
+	replication, err := StartReplication(primary)
+	if err != nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", err, nil)
+	}
+	defer replication.Stop()
+
+	// Setup: commits made while the replica doesn't read the stream.
+	for i := 0; i < 10; i++ {
+		writeTx(fmt.Sprintf("key-%d", i), "a value of some size", primary)
+	}
+
+	// Is the queue bounded, and is the replica dropped?
+	replication.mu.Lock()
+	queued := replication.queued
+	replication.mu.Unlock()
+	if queued != 0 {
+		t.Fatalf("Failed.\nActual: %v bytes.\nExpected: %v bytes.\n", queued, 0)
+	}
+	if err := replication.Send(io.Discard); err != errReplicaBehind {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", err, errReplicaBehind)
+	}
+}
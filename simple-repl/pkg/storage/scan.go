@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+)
+
+// keyValue is a key and the value stored at the key.
+type keyValue struct {
+	key   string
+	value string
+}
+
+// scanTx returns, sorted by key, the keys and values visible to the current
+// transaction for which match returns true. The operations of the current
+// transaction and of every parent transaction are merged in the key table, so a
+// key written or deleted in a transaction hides the key in its parents. Keys
+// the user of the session may not read are left out.
+//
+// The whole range is recorded as read, so a key committed in the range by
+// another transaction conflicts, not only the keys returned.
+func scanTx(match func(key string) bool, currentTx Transaction) []keyValue {
+	scanned := func(key string) bool {
+		return match(key) && canRead(key, currentTx)
+	}
+	markScanned(scanned, currentTx)
+
+	keys := []string{}
+	for key := range knownKeys(currentTx) {
+		if scanned(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	pairs := []keyValue{}
+	for _, key := range keys {
+
+		// Skip the keys that have been deleted or have expired.
+		op, keyExists := lookupTx(key, currentTx)
+		if !keyExists || op.Deleted || op.expired() {
+			continue
+		}
+		pairs = append(pairs, keyValue{key: key, value: op.Value})
+	}
+	return pairs
+}
+
+// Keys returns, sorted, the keys starting with prefix that are visible to the
+// current transaction, e.g to complete the keys typed in the REPL. Unlike SCAN
+// the keys are not recorded as read, so they don't conflict with other transactions.
+func Keys(prefix string, currentTx Transaction) []string {
+	keys := []string{}
+	for key := range knownKeys(currentTx) {
+		if !strings.HasPrefix(key, prefix) || !canRead(key, currentTx) {
+			continue
+		}
+		op, keyExists := lookupTx(key, currentTx)
+		if !keyExists || op.Deleted || op.expired() {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// knownKeys returns every key written or deleted in the current transaction,
+// its parent transactions, the root transaction or a version of it.
+func knownKeys(currentTx Transaction) map[string]struct{} {
+	keys := map[string]struct{}{}
+	if currentTx.parent != nil {
+		for opKey := range currentTx.Operations {
+			keys[opKey] = struct{}{}
+		}
+	}
+	if currentTx.stack != nil {
+		for opKey := range currentTx.stack.table {
+			keys[opKey] = struct{}{}
+		}
+	}
+	iterateRoot(func(key string, op Op) bool {
+		keys[key] = struct{}{}
+		return true
+	}, rootTx(currentTx))
+
+	if currentTx.db != nil {
+		for key := range currentTx.db.versions {
+			keys[key] = struct{}{}
+		}
+	}
+	return keys
+}
+
+// inRange matches the keys from start up to, but not including, end.
+// An empty end matches every key from start on.
+func inRange(start, end string) func(key string) bool {
+	return func(key string) bool {
+		return key >= start && (end == "" || key < end)
+	}
+}
+
+// hasPrefix matches the keys starting with prefix.
+func hasPrefix(prefix string) func(key string) bool {
+	return func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	}
+}
+
+// formatPairs prints one key and its value per line.
+func formatPairs(pairs []keyValue) string {
+	var output strings.Builder
+	for _, pair := range pairs {
+		output.WriteString(pair.key + " " + pair.value + "\n")
+	}
+	return output.String()
+}
+
+// formatKeys prints one key per line.
+func formatKeys(pairs []keyValue) string {
+	var output strings.Builder
+	for _, pair := range pairs {
+		output.WriteString(pair.key + "\n")
+	}
+	return output.String()
+}
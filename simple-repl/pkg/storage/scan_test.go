@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScanTx(t *testing.T) {
+	root := NewRoot()
+	writeTx("user:1", "alice", root)
+	writeTx("user:2", "bob", root)
+	writeTx("user:3", "carol", root)
+	writeTx("group:1", "admins", root)
+
+	// Setup: a transaction deletes user:2 and writes user:4, its nested
+	// transaction overwrites user:1 and restores user:2.
+	tx := startTx(root)
+	deleteTx("user:2", tx)
+	writeTx("user:4", "dave", tx)
+	nested := startTx(tx)
+	writeTx("user:1", "alice-again", nested)
+	writeTx("user:2", "bob-again", nested)
+
+	// Setup: another session's transaction with the same pending changes, but
+	// no nested transaction. A transaction sees the writes of its open nested
+	// transactions, which share its key table.
+	pending := startTx(root)
+	deleteTx("user:2", pending)
+	writeTx("user:4", "dave", pending)
+
+	// Setup: another session commits a key after the transactions started.
+	other := startTx(root)
+	writeTx("user:5", "erin", other)
+	commitTx(other)
+
+	cases := []struct {
+		name      string
+		match     func(key string) bool
+		currentTx Transaction
+		pairs     []keyValue
+	}{
+		{
+			name:      "range in root",
+			match:     inRange("user:1", "user:3"),
+			currentTx: root,
+			pairs:     []keyValue{{"user:1", "alice"}, {"user:2", "bob"}},
+		},
+		{
+			name:      "range without end",
+			match:     inRange("user:3", ""),
+			currentTx: root,
+			pairs:     []keyValue{{"user:3", "carol"}, {"user:5", "erin"}},
+		},
+		{
+			name:      "prefix respects pending deletes",
+			match:     hasPrefix("user:"),
+			currentTx: pending,
+			pairs:     []keyValue{{"user:1", "alice"}, {"user:3", "carol"}, {"user:4", "dave"}},
+		},
+		{
+			name:      "prefix merges the parent chain",
+			match:     hasPrefix("user:"),
+			currentTx: nested,
+			pairs:     []keyValue{{"user:1", "alice-again"}, {"user:2", "bob-again"}, {"user:3", "carol"}, {"user:4", "dave"}},
+		},
+		{
+			name:      "all keys",
+			match:     hasPrefix(""),
+			currentTx: pending,
+			pairs:     []keyValue{{"group:1", "admins"}, {"user:1", "alice"}, {"user:3", "carol"}, {"user:4", "dave"}},
+		},
+		{
+			name:      "no match",
+			match:     hasPrefix("missing"),
+			currentTx: nested,
+			pairs:     []keyValue{},
+		},
+	}
+
+	for _, exp := range cases {
+		actualPairs := scanTx(exp.match, exp.currentTx)
+
+		// Are the visible keys and values returned in sorted order?
+		if !reflect.DeepEqual(actualPairs, exp.pairs) {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: %v.\n", exp.name, actualPairs, exp.pairs)
+		}
+	}
+
+	// Is the output printed one key per line?
+	output := formatPairs([]keyValue{{"a", "hello"}, {"b", "world"}})
+	if output != "a hello\nb world\n" {
+		t.Fatalf("Failed.\nActual: %q.\nExpected: %q.\n", output, "a hello\nb world\n")
+	}
+}
+
+func TestScanTxConflict(t *testing.T) {
+	conflictErr := "ERROR: COMMIT conflict, b was changed by another transaction. The transaction was aborted.\n"
+
+	cases := []struct {
+		name   string
+		key    string
+		nested bool
+		err    string
+	}{
+		{name: "key inserted in the scanned range", key: "b", err: conflictErr},
+		{name: "key inserted in a range scanned by a nested transaction", key: "b", nested: true, err: conflictErr},
+		{name: "key inserted outside of the scanned range", key: "d"},
+	}
+
+	for _, exp := range cases {
+		root := NewRoot()
+		writeTx("c", "3", root)
+
+		// Setup: the transaction scans an empty range and writes the result.
+		tx := startTx(root)
+		scanning := tx
+		if exp.nested {
+			scanning = startTx(tx)
+		}
+		if pairs := scanTx(inRange("a", "c"), scanning); len(pairs) != 0 {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: no keys.\n", exp.name, pairs)
+		}
+		writeTx("count", "0", scanning)
+		if exp.nested {
+			tx, _ = commitTx(scanning)
+		}
+
+		// Setup: another transaction inserts a key and commits first.
+		other := startTx(root)
+		writeTx(exp.key, "2", other)
+		if _, err := commitTx(other); err != nil {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: nil.\n", exp.name, err)
+		}
+
+		// Does the commit fail only if the key was inserted in the scanned range?
+		_, err := commitTx(tx)
+		actualErr := ""
+		if err != nil {
+			actualErr = err.Error()
+		}
+		if actualErr != exp.err {
+			t.Fatalf("Failed %s.\nActual: %q.\nExpected: %q.\n", exp.name, actualErr, exp.err)
+		}
+	}
+}
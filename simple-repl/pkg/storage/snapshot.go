@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	snapshotPrefix = "snapshot-"
+	snapshotSuffix = ".snap"
+
+	// defaultSnapshotEvery is how many records the write-ahead log
+	// holds before a snapshot of the root transaction is taken.
+	defaultSnapshotEvery = 1000
+
+	// snapshotChunkSize is about how many bytes of operations a snapshot
+	// record holds, so a snapshot of any size is written in records that
+	// stay below maxRecordSize.
+	snapshotChunkSize = 1024 * 1024
+)
+
+// snapshotTx writes a snapshot of the root transaction, i.e the last
+// transaction in the parent chain of currentTx.
+func snapshotTx(currentTx Transaction) error {
+	root := rootTx(currentTx)
+
+	// An LSM store is compacted by flushing its memtable to a segment.
+	if store, ok := root.store.(*lsmStore); ok {
+		return store.flush()
+	}
+
+	// Return an error if the store is only kept in memory.
+	if root.disk == nil {
+		return errors.New("ERROR: SNAPSHOT called without a data directory.\n")
+	}
+
+	return root.disk.snapshot(root.Operations)
+}
+
+// snapshot writes the operations of the root transaction to a new snapshot file
+// covering every record in the log. Once the snapshot is durable and reads back,
+// older snapshots are removed and the log is truncated.
+func (d *disk) snapshot(ops map[string]Op) error {
+
+	// A snapshot is named after the sequence number of the last record it covers.
+	// It's written to a temporary file first so a partially written snapshot is
+	// never mistaken for a complete one.
+	path := filepath.Join(d.dir, snapshotName(d.seq))
+	tmpPath := path + ".tmp"
+	var data bytes.Buffer
+	if err := writeSnapshot(&data, d.seq, ops); err != nil {
+		return err
+	}
+	if err := writeFileSync(tmpPath, data.Bytes()); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// The log and the older snapshots are the only other copy of the operations,
+	// so they are kept unless the new snapshot reads back with every operation.
+	seq, readOps, err := readSnapshotFile(tmpPath)
+	if err == nil && (seq != d.seq || len(readOps) != len(ops)) {
+		err = fmt.Errorf("snapshot %d reads back with %d of %d operations", seq, len(readOps), len(ops))
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("snapshot %s does not read back: %v", filepath.Base(path), err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	if err := syncDir(d.dir); err != nil {
+		return err
+	}
+
+	// Older snapshots can not be combined with the truncated log anymore.
+	names, err := snapshotNames(d.dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name != filepath.Base(path) {
+			os.Remove(filepath.Join(d.dir, name))
+		}
+	}
+
+	return d.truncate()
+}
+
+// loadSnapshot calls apply with the operations of the newest valid snapshot and
+// sets the sequence number of the log to the last record the snapshot covers.
+// Snapshots that can not be read or whose checksum does not match are skipped.
+// It returns the last record the newest skipped snapshot covers, if any: the
+// log must hold the records up to it, or the operations of the skipped snapshot
+// are lost.
+func (d *disk) loadSnapshot(apply func(seq uint64, ops map[string]Op)) (uint64, error) {
+	names, err := snapshotNames(d.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	// Try the newest snapshot first.
+	var skipped uint64
+	for i := len(names) - 1; i >= 0; i-- {
+		seq, ops, err := readSnapshotFile(filepath.Join(d.dir, names[i]))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: skipping invalid snapshot %s.\n", names[i])
+			if skipped == 0 {
+				skipped = snapshotSeq(names[i])
+			}
+			continue
+		}
+
+		apply(seq, ops)
+		d.seq = seq
+		return skipped, nil
+	}
+	return skipped, nil
+}
+
+// writeSnapshot writes the operations as a snapshot covering the records up to
+// seq. A snapshot is a sequence of log records numbered seq, each holding about
+// snapshotChunkSize bytes of the operations, deleted keys included, and ends
+// with a record without operations.
+func writeSnapshot(w io.Writer, seq uint64, ops map[string]Op) error {
+	for _, chunk := range chunkOps(ops) {
+		if _, err := w.Write(encodeRecord(seq, chunk)); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(encodeRecord(seq, map[string]Op{}))
+	return err
+}
+
+// readSnapshot reads a snapshot written by writeSnapshot. It returns the sequence
+// number of the last record the snapshot covers and the operations. It returns
+// io.EOF only if the reader ends before the snapshot starts.
+func readSnapshot(reader *bufio.Reader) (uint64, map[string]Op, error) {
+	ops := map[string]Op{}
+	var seq uint64
+	for first := true; ; first = false {
+		recordSeq, chunk, _, err := readRecord(reader)
+		if err == io.EOF && !first {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if !first && recordSeq != seq {
+			return 0, nil, errCorruptRecord
+		}
+		seq = recordSeq
+
+		if len(chunk) == 0 {
+			return seq, ops, nil
+		}
+		for opKey, op := range chunk {
+			ops[opKey] = op
+		}
+	}
+}
+
+// readSnapshotFile reads the snapshot in the file at path, see readSnapshot.
+func readSnapshotFile(path string) (uint64, map[string]Op, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+	return readSnapshot(bufio.NewReader(file))
+}
+
+// chunkOps splits the operations in chunks of about snapshotChunkSize bytes once
+// encoded. An operation larger than that is a chunk of its own.
+func chunkOps(ops map[string]Op) []map[string]Op {
+	chunks := []map[string]Op{}
+	chunk, size := map[string]Op{}, 0
+	for opKey, op := range ops {
+		opSize := len(opKey) + len(op.Value) + 1 + 3*binary.MaxVarintLen64
+		if size > 0 && size+opSize > snapshotChunkSize {
+			chunks = append(chunks, chunk)
+			chunk, size = map[string]Op{}, 0
+		}
+		chunk[opKey] = op
+		size += opSize
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// snapshotName returns the file name of the snapshot covering the records up to seq.
+// The sequence number is zero padded so the names sort in the order they were written.
+func snapshotName(seq uint64) string {
+	return fmt.Sprintf("%s%020d%s", snapshotPrefix, seq, snapshotSuffix)
+}
+
+// snapshotSeq returns the last record covered by the snapshot with the file name.
+func snapshotSeq(name string) uint64 {
+	seq, _ := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotSuffix), 10, 64)
+	return seq
+}
+
+// snapshotNames returns the file names of the snapshots in dir, oldest first.
+func snapshotNames(dir string) ([]string, error) {
+	return fileNames(dir, snapshotPrefix, snapshotSuffix)
+}
+
+// fileNames returns the sorted names of the files in dir with the prefix and suffix.
+func fileNames(dir, prefix, suffix string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, prefix) && strings.HasSuffix(name, suffix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// writeFileSync writes data to the file at path and syncs it to stable storage.
+func writeFileSync(path string, data []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// syncDir syncs the directory so a renamed file survives a crash.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
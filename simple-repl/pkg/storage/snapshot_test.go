@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotTx(t *testing.T) {
+
+	// Case 1: the store is only kept in memory.
+	root := NewRootWith(NewMemStore())
+	err := snapshotTx(startTx(root))
+	if err == nil || err.Error() != "ERROR: SNAPSHOT called without a data directory.\n" {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", err, "ERROR: SNAPSHOT called without a data directory.\n")
+	}
+
+	// Case 2: the store is durable, the snapshot covers the log and
+	// recovery replays only the records that follow the snapshot.
+	dir := t.TempDir()
+	root, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTx("a", "hello", root)
+	writeTx("b", "world", root)
+	deleteTx("b", root)
+
+	// A snapshot taken inside a transaction only covers the root transaction.
+	child := startTx(root)
+	writeTx("c", "pending", child)
+	if err := snapshotTx(child); err != nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: nil.\n", err)
+	}
+
+	// Is the log truncated?
+	info, _ := os.Stat(filepath.Join(dir, walFileName))
+	if info.Size() != 0 {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: 0.\n", info.Size())
+	}
+
+	commitTx(child)
+	writeTx("d", "after", root)
+	root.disk.file.Close()
+
+	recovered, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.disk.file.Close()
+
+	expected := map[string]string{"a": "hello", "c": "pending", "d": "after"}
+	for key, value := range expected {
+		actualOutput, _ := readTx(key, recovered)
+		if actualOutput != value {
+			t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", actualOutput, value)
+		}
+	}
+	if _, err := readTx("b", recovered); err == nil {
+		t.Fatalf("Failed.\nActual: nil.\nExpected: %v.\n", "Key not found: b")
+	}
+
+	// Are the following records numbered after the snapshot?
+	if recovered.disk.seq != 5 || recovered.disk.records != 2 {
+		t.Fatalf("Failed.\nActual: %v, %v.\nExpected: 5, 2.\n", recovered.disk.seq, recovered.disk.records)
+	}
+}
+
+func TestSnapshotEvery(t *testing.T) {
+	dir := t.TempDir()
+	root, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root.disk.snapshotEvery = 2
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		writeTx(key, "value-"+key, root)
+	}
+
+	// Is a snapshot taken once the log holds snapshotEvery records?
+	names, _ := snapshotNames(dir)
+	if len(names) != 1 || names[0] != snapshotName(4) {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", names, snapshotName(4))
+	}
+	if root.disk.records != 1 {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: 1.\n", root.disk.records)
+	}
+	root.disk.file.Close()
+
+	recovered, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.disk.file.Close()
+	if len(recovered.Operations) != 5 {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: 5 keys.\n", recovered.Operations)
+	}
+}
+
+func TestLoadSnapshotSkipsInvalid(t *testing.T) {
+	dir := t.TempDir()
+
+	// Setup: a valid snapshot covering record 1, a corrupt newer
+	// snapshot covering record 2 and a log holding records 2 and 3.
+	var valid, corrupt bytes.Buffer
+	writeSnapshot(&valid, 1, map[string]Op{"a": {Value: "hello"}})
+	writeFileSync(filepath.Join(dir, snapshotName(1)), valid.Bytes())
+	writeSnapshot(&corrupt, 2, map[string]Op{"a": {Value: "lost"}})
+	corrupt.Bytes()[corrupt.Len()-1] ^= 0xff
+	writeFileSync(filepath.Join(dir, snapshotName(2)), corrupt.Bytes())
+
+	log := encodeRecord(2, map[string]Op{"b": {Value: "world"}})
+	log = append(log, encodeRecord(3, map[string]Op{"a": {Value: "hello-again"}})...)
+	writeFileSync(filepath.Join(dir, walFileName), log)
+
+	root, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: nil.\n", err)
+	}
+	defer root.disk.file.Close()
+
+	// Is the newest valid snapshot loaded and the log suffix replayed?
+	if root.Operations["a"].Value != "hello-again" || root.Operations["b"].Value != "world" {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", root.Operations, "a=hello-again b=world")
+	}
+}
+
+func TestOpenRejectsInvalidSnapshot(t *testing.T) {
+	var valid, corrupt bytes.Buffer
+	writeSnapshot(&valid, 1, map[string]Op{"a": {Value: "hello"}})
+	writeSnapshot(&corrupt, 2, map[string]Op{"a": {Value: "hello-again"}})
+	corrupt.Bytes()[corrupt.Len()-1] ^= 0xff
+
+	cases := []struct {
+		name  string
+		valid bool
+	}{
+		{"only the invalid snapshot", false},
+		{"an older valid snapshot", true},
+	}
+
+	for _, exp := range cases {
+		// Setup: the newest snapshot is corrupt and the log is empty.
+		dir := t.TempDir()
+		if exp.valid {
+			writeFileSync(filepath.Join(dir, snapshotName(1)), valid.Bytes())
+		}
+		writeFileSync(filepath.Join(dir, snapshotName(2)), corrupt.Bytes())
+
+		// Does the recovery fail instead of losing the operations of the snapshot?
+		root, err := Open(dir)
+		if err == nil {
+			root.disk.file.Close()
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: an error.\n", exp.name, root.Operations)
+		}
+	}
+}
+
+func TestSnapshotLargerThanRecord(t *testing.T) {
+	dir := t.TempDir()
+	root, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Setup: more operations than fit in one log record.
+	value := strings.Repeat("x", 1024*1024)
+	for i := 0; i < 70; i++ {
+		writeTx(fmt.Sprintf("key-%d", i), value, root)
+	}
+	if err := snapshotTx(root); err != nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: nil.\n", err)
+	}
+
+	// Is the snapshot written, and the log truncated?
+	names, _ := snapshotNames(dir)
+	info, _ := os.Stat(filepath.Join(dir, walFileName))
+	if len(names) != 1 || info.Size() != 0 {
+		t.Fatalf("Failed.\nActual: %v, %v.\nExpected: %v, 0.\n", names, info.Size(), snapshotName(70))
+	}
+	root.disk.file.Close()
+
+	// Is every key recovered from the snapshot?
+	recovered, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: nil.\n", err)
+	}
+	defer recovered.disk.file.Close()
+	if len(recovered.Operations) != 70 {
+		t.Fatalf("Failed.\nActual: %v keys.\nExpected: 70 keys.\n", len(recovered.Operations))
+	}
+	for i := 0; i < 70; i++ {
+		if actualOutput, _ := readTx(fmt.Sprintf("key-%d", i), recovered); actualOutput != value {
+			t.Fatalf("Failed.\nActual: %d bytes.\nExpected: %d bytes.\n", len(actualOutput), len(value))
+		}
+	}
+}
+
+func TestReadSnapshotRejectsIncomplete(t *testing.T) {
+	var snapshot bytes.Buffer
+	writeSnapshot(&snapshot, 1, map[string]Op{"a": {Value: "hello"}})
+	end := encodeRecord(1, map[string]Op{})
+
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{"without the end record", snapshot.Bytes()[:snapshot.Len()-len(end)]},
+		{"records of another snapshot", append(encodeRecord(1, map[string]Op{"a": {Value: "hello"}}), encodeRecord(2, map[string]Op{})...)},
+	}
+
+	for _, exp := range cases {
+		if _, _, err := readSnapshot(bufio.NewReader(bytes.NewReader(exp.data))); err == nil {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: an error.\n", exp.name, err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"sort"
+)
+
+// Store is the backend holding the operations committed to the root transaction.
+// Deleted keys are kept as tombstones, so a deleted key is told apart from one
+// that was never written.
+type Store interface {
+
+	// Get returns the last operation on the key and whether the key was ever written.
+	Get(key string) (Op, bool, error)
+
+	// Put records the operation on the key.
+	Put(key string, op Op) error
+
+	// Delete records a tombstone for the key.
+	Delete(key string) error
+
+	// Iterate calls fn with every key and the last operation on it, sorted
+	// by key, until fn returns false.
+	Iterate(fn func(key string, op Op) bool) error
+
+	// Apply records every operation or, if it fails, none of them.
+	Apply(ops map[string]Op) error
+
+	// Close releases the resources held by the store.
+	Close() error
+}
+
+// newStore returns the store of a new root transaction. It's a variable
+// so the tests can run against every backend.
+var newStore = NewMemStore
+
+// memStore is a Store kept in memory.
+type memStore map[string]Op
+
+// NewMemStore returns an empty Store kept in memory.
+func NewMemStore() Store {
+	return memStore{}
+}
+
+func (m memStore) Get(key string) (Op, bool, error) {
+	op, keyExists := m[key]
+	return op, keyExists, nil
+}
+
+func (m memStore) Put(key string, op Op) error {
+	m[key] = op
+	return nil
+}
+
+func (m memStore) Delete(key string) error {
+	m[key] = tombstone
+	return nil
+}
+
+func (m memStore) Iterate(fn func(key string, op Op) bool) error {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !fn(key, m[key]) {
+			break
+		}
+	}
+	return nil
+}
+
+func (m memStore) Apply(ops map[string]Op) error {
+	for opKey, op := range ops {
+		m[opKey] = op
+	}
+	return nil
+}
+
+func (m memStore) Close() error {
+	return nil
+}
+
+// getRoot returns the last operation on the key in the root transaction. A root
+// transaction without a store keeps its operations in Operations.
+//
+// A read error can't be returned to every caller, e.g existsTx, so it's kept
+// by the db and returned by ExecuteOp once the command is done.
+func getRoot(key string, root Transaction) (Op, bool) {
+	if root.store == nil {
+		op, keyExists := root.Operations[key]
+		return op, keyExists
+	}
+
+	op, keyExists, err := root.store.Get(key)
+	if err != nil {
+		root.db.fail(err)
+	}
+	return op, keyExists
+}
+
+// applyRoot applies the operations to the root transaction.
+func applyRoot(ops map[string]Op, root Transaction) error {
+	if root.store == nil {
+		for opKey, op := range ops {
+			root.Operations[opKey] = op
+		}
+		return nil
+	}
+	return root.store.Apply(ops)
+}
+
+// iterateRoot calls fn with every key of the root transaction and the last
+// operation on it until fn returns false. Read errors are kept like in getRoot.
+func iterateRoot(fn func(key string, op Op) bool, root Transaction) {
+	if root.store == nil {
+		for opKey, op := range root.Operations {
+			if !fn(opKey, op) {
+				return
+			}
+		}
+		return
+	}
+
+	if err := root.store.Iterate(fn); err != nil {
+		root.db.fail(err)
+	}
+}
@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain runs every test of the package once for each backend: the root
+// transactions returned by NewRoot keep their operations in the backend's store.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "storage")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	backends := []struct {
+		name     string
+		newStore func() Store
+	}{
+		{"memory", NewMemStore},
+		{"lsm", func() Store {
+			storeDir, err := os.MkdirTemp(dir, "lsm")
+			if err != nil {
+				panic(err)
+			}
+			return openTestLSMStore(storeDir)
+		}},
+	}
+
+	code := 0
+	for _, backend := range backends {
+		fmt.Printf("Running the tests against the %s store.\n", backend.name)
+		newStore = backend.newStore
+		if code = m.Run(); code != 0 {
+			break
+		}
+	}
+	newStore = NewMemStore
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// openTestLSMStore opens an LSM store that flushes and compacts often,
+// so the segments are exercised by small tests.
+func openTestLSMStore(dir string) Store {
+	store, err := OpenLSMStore(dir)
+	if err != nil {
+		panic(err)
+	}
+	store.(*lsmStore).flushEvery = 2
+	store.(*lsmStore).compactEvery = 3
+	return store
+}
+
+// newTestRoot returns a root transaction whose store, of the backend the tests
+// run against, holds the operations.
+func newTestRoot(ops map[string]Op) Transaction {
+	root := NewRoot()
+	if err := root.store.Apply(ops); err != nil {
+		panic(err)
+	}
+	return root
+}
+
+// TestOperationsOnStore runs the operations of the baseline tests, which use
+// root transactions without a store, on a root transaction kept in the store of
+// the backend the tests run against.
+func TestOperationsOnStore(t *testing.T) {
+	root := newTestRoot(map[string]Op{"a": {Value: "hello"}, "b": tombstone})
+
+	// Are the keys of the store read, deleted ones included?
+	if value, err := readTx("a", root); err != nil || value != "hello" {
+		t.Fatalf("Failed.\nActual: %v, %v.\nExpected: %v.\n", value, err, "hello")
+	}
+	for _, key := range []string{"b", "c"} {
+		if _, err := readTx(key, root); err == nil {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: an error.\n", key, err)
+		}
+	}
+
+	// Are the writes and deletions of the root transaction kept in the store?
+	writeTx("c", "world", root)
+	deleteTx("a", root)
+	expected := map[string]Op{"a": tombstone, "b": tombstone, "c": {Value: "world"}}
+	if !reflect.DeepEqual(rootOps(root), expected) {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", rootOps(root), expected)
+	}
+
+	// Are committed transactions applied to the store, and aborted ones not?
+	tx := startTx(root)
+	writeTx("d", "committed", tx)
+	if tx, err := commitTx(tx); err != nil || tx.parent != nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: nil.\n", err)
+	}
+	tx = startTx(root)
+	writeTx("e", "aborted", tx)
+	abortTx(tx)
+	expected["d"] = Op{Value: "committed"}
+	if !reflect.DeepEqual(rootOps(root), expected) {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", rootOps(root), expected)
+	}
+
+	// Can't the root transaction be committed or aborted?
+	if _, err := commitTx(root); err == nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: an error.\n", err)
+	}
+	if _, err := abortTx(root); err == nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: an error.\n", err)
+	}
+}
+
+func TestStore(t *testing.T) {
+	expiresAt := time.Unix(2000, 0)
+
+	for _, store := range []Store{NewMemStore(), openTestLSMStore(t.TempDir())} {
+		defer store.Close()
+
+		store.Put("a", Op{Value: "hello"})
+		store.Put("b", Op{Value: "world"})
+		store.Put("c", Op{Value: "temporary", ExpiresAt: expiresAt})
+		store.Apply(map[string]Op{"a": {Value: "hello-again"}, "d": {Value: ""}, "e": {Value: "gone"}})
+		store.Delete("e")
+		store.Put("b", Op{Value: "world\nagain"})
+
+		expected := map[string]Op{
+			"a": {Value: "hello-again"},
+			"b": {Value: "world\nagain"},
+			"c": {Value: "temporary", ExpiresAt: expiresAt},
+			"d": {Value: ""},
+			"e": tombstone,
+		}
+
+		// Is the last operation on each key returned?
+		for key, op := range expected {
+			actualOp, keyExists, err := store.Get(key)
+			if err != nil || !keyExists || !reflect.DeepEqual(actualOp, op) {
+				t.Fatalf("Failed %T.\nActual: %v, %v, %v.\nExpected: %v.\n", store, actualOp, keyExists, err, op)
+			}
+		}
+
+		// Is a key that was never written missing?
+		if _, keyExists, _ := store.Get("f"); keyExists {
+			t.Fatalf("Failed %T.\nActual: %v.\nExpected: false.\n", store, keyExists)
+		}
+
+		// Are the keys iterated in order until fn returns false?
+		keys := []string{}
+		store.Iterate(func(key string, op Op) bool {
+			keys = append(keys, key)
+			return key < "d"
+		})
+		if !reflect.DeepEqual(keys, []string{"a", "b", "c", "d"}) {
+			t.Fatalf("Failed %T.\nActual: %v.\nExpected: a to d.\n", store, keys)
+		}
+	}
+}
+
+func TestOpenLSMStoreRecovers(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestLSMStore(dir)
+
+	// Setup: enough writes to flush the memtable to segments and compact them,
+	// with the last writes left in the write-ahead log.
+	for i := 0; i < 10; i++ {
+		store.Put(fmt.Sprintf("key-%d", i%4), Op{Value: fmt.Sprintf("value-%d", i)})
+	}
+	store.Delete("key-0")
+
+	// Is the number of segments kept down by compaction?
+	if actual := len(store.(*lsmStore).segments); actual >= 3 {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: less than 3 segments.\n", actual)
+	}
+	store.Close()
+
+	recovered, err := OpenLSMStore(dir)
+	if err != nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: nil.\n", err)
+	}
+	defer recovered.Close()
+
+	// Are the segments and the log recovered?
+	expected := map[string]Op{"key-0": tombstone, "key-1": {Value: "value-9"}, "key-2": {Value: "value-6"}, "key-3": {Value: "value-7"}}
+	for key, op := range expected {
+		actualOp, _, err := recovered.Get(key)
+		if err != nil || actualOp != op {
+			t.Fatalf("Failed %s.\nActual: %v, %v.\nExpected: %v.\n", key, actualOp, err, op)
+		}
+	}
+
+	// Is a corrupt segment reported instead of silently losing its keys?
+	names, _ := fileNames(dir, segmentPrefix, segmentSuffix)
+	recovered.Close()
+	path := filepath.Join(dir, names[0])
+	data, _ := os.ReadFile(path)
+	data[len(data)-segmentFooterSize-1] ^= 0xff
+	os.WriteFile(path, data, 0644)
+	if _, err := OpenLSMStore(dir); err == nil {
+		t.Fatalf("Failed.\nActual: nil.\nExpected: corrupt segment error.\n")
+	}
+}
+
+func TestCommitFailingInStore(t *testing.T) {
+	store := openTestLSMStore(t.TempDir())
+	defer store.Close()
+	root := NewRootWith(store)
+	writeTx("a", "hello", root)
+
+	// Case setup: a transaction that keeps a snapshot pinned, and a commit the
+	// store can't log, so Apply fails.
+	reader := startTx(root)
+	writer := startTx(root)
+	writeTx("big", strings.Repeat("x", maxRecordSize), writer)
+	writer, err := commitTx(writer)
+	if err == nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: an error.\n", err)
+	}
+
+	// Are the clock and the history left as they were?
+	if root.db.now() != 1 {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", root.db.now(), 1)
+	}
+	if history, _ := historyTx("", root); history != "1 WRITE a hello\n" {
+		t.Fatalf("Failed.\nActual: %q.\nExpected: %q.\n", history, "1 WRITE a hello\n")
+	}
+
+	// Does a new transaction not see the failed commit?
+	if actual := existsTx("big", startTx(root)); actual != "never set" {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", actual, "never set")
+	}
+
+	// Does retrying the commit succeed, without conflicting with itself?
+	writeTx("big", "small", writer)
+	if writer, err = commitTx(writer); err != nil || writer.parent != nil {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: nil.\n", err)
+	}
+	if actual, _ := readTx("big", root); actual != "small" {
+		t.Fatalf("Failed.\nActual: %v.\nExpected: %v.\n", actual, "small")
+	}
+	abortTx(reader)
+}
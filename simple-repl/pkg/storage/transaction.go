@@ -1,35 +1,190 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strings"
+	"time"
 )
 
+// Op is the last operation on a key: either a write of the value or a deletion.
+// A written value expires at ExpiresAt, unless it's the zero time.
+type Op struct {
+	Value     string
+	Deleted   bool
+	ExpiresAt time.Time
+}
+
+// tombstone is the operation recorded when a key is deleted.
+var tombstone = Op{Deleted: true}
+
 // Transaction contains a map of key/value operations and a pointer to it's parent transaction.
 type Transaction struct {
-	Operations map[string]string
+	Operations map[string]Op
 	parent     *Transaction
+
+	// stack is shared by a transaction started from the root transaction and
+	// every transaction nested in it, see startTx. undo holds the operation the
+	// key table of the stack had for each key before the transaction first wrote
+	// the key, an ABORT puts them back.
+	stack *stack
+	undo  map[string]undoEntry
+
+	// name is the name of the savepoint that started the transaction, if any.
+	name string
+
+	// store holds the operations of the root transaction.
+	store Store
+
+	// disk is the write-ahead log of a durable root transaction.
+	disk *disk
+
+	// db is shared by the root transaction and every transaction started from it.
+	db *db
+
+	// snapshot is the clock value of the db the transaction reads the root
+	// transaction at. reads holds the keys read by the transaction and scans the
+	// ranges of keys it scanned, see markScanned. Together with the keys in
+	// Operations they are checked for conflicts when it commits.
+	snapshot uint64
+	reads    map[string]struct{}
+	scans    *[]func(key string) bool
+
+	// user is the authenticated user of the session, whose permissions are checked
+	// by ExecuteOp, and accounts are the users it can authenticate as. A session
+	// without a user can do anything.
+	user     *User
+	accounts *Accounts
 }
 
 // ExecuteOp executes the operation passed into the REPL.
-func ExecuteOp(cmd, key, value string, currentTx Transaction) (Transaction, string, error) {
+func ExecuteOp(cmd string, args []string, currentTx Transaction) (Transaction, string, error) {
 	var output string
 	var err error
 
+	// Most commands take a key and a value, missing arguments are empty.
+	key, value := arg(args, 0), arg(args, 1)
+
+	// The user of the session needs permission to access the key, or the store.
+	if err := authorize(strings.ToUpper(cmd), key, currentTx); err != nil {
+		return currentTx, output, err
+	}
+
+	// Expired keys are reclaimed lazily, when a command accesses them.
+	if err := reclaimExpired([]string{key}, rootTx(currentTx)); err != nil {
+		return currentTx, output, err
+	}
+
 	switch strings.ToUpper(cmd) {
 	case "READ":
 		{
+			markRead(key, currentTx)
 			output, err = readTx(key, currentTx)
 			output += "\n"
 		}
+	case "EXISTS":
+		{
+			markRead(key, currentTx)
+			output = existsTx(key, currentTx) + "\n"
+		}
+	case "SCAN":
+		{
+			output = formatPairs(scanTx(inRange(key, value), currentTx))
+		}
+	case "PREFIX":
+		{
+			output = formatPairs(scanTx(hasPrefix(key), currentTx))
+		}
+	case "KEYS":
+		{
+			output = formatKeys(scanTx(hasPrefix(""), currentTx))
+		}
 	case "WRITE":
 		{
-			writeTx(key, value, currentTx)
+			var expiresAt time.Time
+			if len(args) > 2 {
+				if expiresAt, err = parseExpiry(args[2:]); err != nil {
+					break
+				}
+			}
+			err = putTx(key, Op{Value: value, ExpiresAt: expiresAt}, currentTx)
+		}
+	case "TTL":
+		{
+			markRead(key, currentTx)
+			output, err = ttlTx(key, currentTx)
+			output += "\n"
+		}
+	case "PERSIST":
+		{
+			markRead(key, currentTx)
+			err = persistKeyTx(key, currentTx)
 		}
 	case "DELETE":
 		{
-			deleteTx(key, currentTx)
+			err = deleteTx(key, currentTx)
+		}
+	case "INCR":
+		{
+			markRead(key, currentTx)
+			if output, err = incrByTx(key, 1, currentTx); err == nil {
+				output += "\n"
+			}
+		}
+	case "DECR":
+		{
+			markRead(key, currentTx)
+			if output, err = incrByTx(key, -1, currentTx); err == nil {
+				output += "\n"
+			}
+		}
+	case "INCRBY":
+		{
+			var amount int64
+			if amount, err = parseAmount(value); err != nil {
+				break
+			}
+			markRead(key, currentTx)
+			if output, err = incrByTx(key, amount, currentTx); err == nil {
+				output += "\n"
+			}
+		}
+	case "APPEND":
+		{
+			markRead(key, currentTx)
+			if output, err = appendTx(key, value, currentTx); err == nil {
+				output += "\n"
+			}
+		}
+	case "CAS":
+		{
+			markRead(key, currentTx)
+			err = casTx(key, value, arg(args, 2), currentTx)
+		}
+	case "STATUS":
+		{
+			output = statusTx(currentTx)
+		}
+	case "DIFF":
+		{
+			output, err = diffTx(currentTx)
+		}
+	case "HISTORY":
+		{
+			output, err = historyTx(key, currentTx)
+		}
+	case "DUMP":
+		{
+			err = dumpTx(key, value, currentTx)
+		}
+	case "LOAD":
+		{
+			err = loadTx(key, value, currentTx)
+		}
+	case "AUTH":
+		{
+			currentTx, err = authTx(args, currentTx)
 		}
 	case "START":
 		{
@@ -37,17 +192,59 @@ func ExecuteOp(cmd, key, value string, currentTx Transaction) (Transaction, stri
 		}
 	case "COMMIT":
 		{
+			if strings.ToUpper(key) == "ALL" {
+				currentTx, err = commitAllTx(currentTx)
+				break
+			}
 			currentTx, err = commitTx(currentTx)
 		}
 	case "ABORT":
 		{
+			if strings.ToUpper(key) == "ALL" {
+				currentTx, err = abortAllTx(currentTx)
+				break
+			}
 			currentTx, err = abortTx(currentTx)
 		}
+	case "SAVEPOINT":
+		{
+			currentTx, err = savepointTx(key, currentTx)
+		}
+	case "ROLLBACK":
+		{
+			// The savepoint name follows the TO keyword: ROLLBACK TO <name>.
+			if strings.ToUpper(key) != "TO" {
+				err = errors.New("ERROR: ROLLBACK must be followed by TO <savepoint>.\n")
+				break
+			}
+			currentTx, err = rollbackToTx(value, currentTx)
+		}
+	case "RELEASE":
+		{
+			currentTx, err = releaseTx(key, currentTx)
+		}
+	case "SNAPSHOT":
+		{
+			err = snapshotTx(currentTx)
+		}
 	case "QUIT":
 		{
 			fmt.Fprintf(os.Stderr, "Exiting...\n")
 			os.Exit(0)
 		}
 	}
+
+	// Reading the store of the root transaction failed during the command.
+	if storeErr := currentTx.db.takeErr(); storeErr != nil && err == nil {
+		err = fmt.Errorf("ERROR: reading the store failed: %v.\n", storeErr)
+	}
 	return currentTx, output, err
 }
+
+// arg returns the argument at index i, or an empty string if there is none.
+func arg(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return ""
+}
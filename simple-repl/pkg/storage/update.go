@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// incrByTx adds amount to the integer stored at the key and returns the new value.
+// A key that does not exist is treated as 0. The time to live of the key is kept.
+func incrByTx(key string, amount int64, currentTx Transaction) (string, error) {
+	op, keyExists := liveOp(key, currentTx)
+	current, err := parseInt(key, op, keyExists)
+	if err != nil {
+		return "", err
+	}
+
+	if (amount > 0 && current > math.MaxInt64-amount) || (amount < 0 && current < math.MinInt64-amount) {
+		return "", fmt.Errorf("ERROR: incrementing %s by %d would overflow.\n", key, amount)
+	}
+
+	value := strconv.FormatInt(current+amount, 10)
+	if err := putTx(key, Op{Value: value, ExpiresAt: op.ExpiresAt}, currentTx); err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// appendTx appends the suffix to the value stored at the key and returns the new value.
+// A key that does not exist is treated as an empty string. The time to live of the key is kept.
+func appendTx(key, suffix string, currentTx Transaction) (string, error) {
+	op, _ := liveOp(key, currentTx)
+
+	value := op.Value + suffix
+	if err := putTx(key, Op{Value: value, ExpiresAt: op.ExpiresAt}, currentTx); err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// casTx writes the new value to the key only if it currently holds the expected value.
+func casTx(key, expected, value string, currentTx Transaction) error {
+	current, err := readTx(key, currentTx)
+	if err != nil {
+		return fmt.Errorf("ERROR: CAS of %s failed, the key does not exist.\n", key)
+	}
+	if current != expected {
+		return fmt.Errorf("ERROR: CAS of %s failed, expected %s but found %s.\n", key, expected, current)
+	}
+	return writeTx(key, value, currentTx)
+}
+
+// liveOp returns the operation that wrote the value of the key and whether the
+// key exists. If the key does not exist, has been deleted or has expired the
+// zero operation and false are returned.
+func liveOp(key string, currentTx Transaction) (Op, bool) {
+	op, keyExists := lookupTx(key, currentTx)
+	if !keyExists || op.Deleted || op.expired() {
+		return Op{}, false
+	}
+	return op, true
+}
+
+// parseInt parses the integer written by the operation on the key.
+// A key that does not exist is 0.
+func parseInt(key string, op Op, keyExists bool) (int64, error) {
+	if !keyExists {
+		return 0, nil
+	}
+
+	current, err := strconv.ParseInt(op.Value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("ERROR: value of %s is not an integer.\n", key)
+	}
+	return current, nil
+}
+
+// parseAmount parses the amount argument of INCRBY.
+func parseAmount(amount string) (int64, error) {
+	n, err := strconv.ParseInt(amount, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("ERROR: INCRBY amount %s is not an integer.\n", amount)
+	}
+	return n, nil
+}
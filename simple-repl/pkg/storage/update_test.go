@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestUpdateTx(t *testing.T) {
+	cases := []struct {
+		name   string
+		inputs [][]string
+		output string
+		err    string
+		key    string
+		value  string
+	}{
+		{
+			name:   "increment a missing key",
+			inputs: [][]string{{"INCR", "n"}},
+			output: "1\n",
+			key:    "n",
+			value:  "1",
+		},
+		{
+			name:   "decrement a deleted key",
+			inputs: [][]string{{"WRITE", "n", "5"}, {"DELETE", "n"}, {"DECR", "n"}},
+			output: "-1\n",
+			key:    "n",
+			value:  "-1",
+		},
+		{
+			name:   "increment by an amount",
+			inputs: [][]string{{"WRITE", "n", "5"}, {"INCRBY", "n", "-12"}},
+			output: "-7\n",
+			key:    "n",
+			value:  "-7",
+		},
+		{
+			name:   "increment a value that is not an integer",
+			inputs: [][]string{{"WRITE", "n", "five"}, {"INCR", "n"}},
+			err:    "ERROR: value of n is not an integer.\n",
+			key:    "n",
+			value:  "five",
+		},
+		{
+			name:   "increment an empty string",
+			inputs: [][]string{{"WRITE", "n", ""}, {"INCR", "n"}},
+			err:    "ERROR: value of n is not an integer.\n",
+			key:    "n",
+			value:  "",
+		},
+		{
+			name:   "increment an empty string that expires",
+			inputs: [][]string{{"WRITE", "n", "", "EX", "60"}, {"INCR", "n"}},
+			err:    "ERROR: value of n is not an integer.\n",
+			key:    "n",
+			value:  "",
+		},
+		{
+			name:   "increment by an amount that is not an integer",
+			inputs: [][]string{{"WRITE", "n", "5"}, {"INCRBY", "n", "x"}},
+			err:    "ERROR: INCRBY amount x is not an integer.\n",
+			key:    "n",
+			value:  "5",
+		},
+		{
+			name:   "increment past the largest integer",
+			inputs: [][]string{{"WRITE", "n", "9223372036854775807"}, {"INCR", "n"}},
+			err:    "ERROR: incrementing n by 1 would overflow.\n",
+			key:    "n",
+			value:  "9223372036854775807",
+		},
+		{
+			name:   "increment the value of a parent transaction",
+			inputs: [][]string{{"WRITE", "n", "5"}, {"START"}, {"START"}, {"INCR", "n"}, {"COMMIT"}, {"INCR", "n"}},
+			output: "7\n",
+			key:    "n",
+			value:  "7",
+		},
+		{
+			name:   "increment in an aborted transaction",
+			inputs: [][]string{{"WRITE", "n", "5"}, {"START"}, {"INCR", "n"}, {"ABORT"}},
+			key:    "n",
+			value:  "5",
+		},
+		{
+			name:   "append to the value of a parent transaction",
+			inputs: [][]string{{"WRITE", "s", "hello"}, {"START"}, {"APPEND", "s", "-again"}},
+			output: "hello-again\n",
+			key:    "s",
+			value:  "hello-again",
+		},
+		{
+			name:   "append to a missing key",
+			inputs: [][]string{{"APPEND", "s", "hello"}},
+			output: "hello\n",
+			key:    "s",
+			value:  "hello",
+		},
+		{
+			name:   "compare and swap",
+			inputs: [][]string{{"WRITE", "a", "hello"}, {"START"}, {"CAS", "a", "hello", "hello-again"}},
+			key:    "a",
+			value:  "hello-again",
+		},
+		{
+			name:   "compare and swap a different value",
+			inputs: [][]string{{"WRITE", "a", "hello"}, {"CAS", "a", "bye", "hello-again"}},
+			err:    "ERROR: CAS of a failed, expected bye but found hello.\n",
+			key:    "a",
+			value:  "hello",
+		},
+		{
+			name:   "compare and swap a missing key",
+			inputs: [][]string{{"CAS", "a", "hello", "hello-again"}},
+			err:    "ERROR: CAS of a failed, the key does not exist.\n",
+			key:    "a",
+			value:  "",
+		},
+	}
+
+	for _, exp := range cases {
+		currentTx := NewRoot()
+		var output string
+		var err error
+		for _, input := range exp.inputs {
+			currentTx, output, err = ExecuteOp(input[0], input[1:], currentTx)
+		}
+
+		// Is the correct output returned by the last command?
+		if output != exp.output {
+			t.Fatalf("Failed %s.\nActual: %q.\nExpected: %q.\n", exp.name, output, exp.output)
+		}
+
+		// Is the correct error returned by the last command?
+		var actualMsg string
+		if err != nil {
+			actualMsg = err.Error()
+		}
+		if actualMsg != exp.err {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: %v.\n", exp.name, actualMsg, exp.err)
+		}
+
+		// Is the updated value visible through the parent chain?
+		actualValue, _ := readTx(exp.key, currentTx)
+		if actualValue != exp.value {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: %v.\n", exp.name, actualValue, exp.value)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Event is a change of a key committed to the root transaction.
+type Event struct {
+
+	// Commit is the number of the commit, as shown by HISTORY.
+	Commit uint64
+	Key    string
+	Op     Op
+}
+
+// String formats the event like a line of HISTORY.
+func (e Event) String() string {
+	return fmt.Sprintf("%d %s", e.Commit, formatOp(e.Key, e.Op))
+}
+
+// Watch calls fn with an Event for every change of a key matching the pattern that
+// is committed to the root transaction of currentTx. The pattern is a key or, when
+// it ends with *, a prefix. Changes made in a child transaction are only notified
+// once they are committed to the root transaction, and never if they are aborted.
+// Changes of keys the user of the session may not read are not notified.
+//
+// It returns an error if the user may read none of the keys matching the pattern.
+//
+// fn is called during the commit, so it must not block. The returned function
+// stops the notifications.
+func Watch(currentTx Transaction, pattern string, fn func(Event)) (func(), error) {
+	if err := checkWatch(pattern, currentTx); err != nil {
+		return nil, err
+	}
+	return watchCommits(currentTx, func(commit uint64, ops map[string]Op) {
+		keys := []string{}
+		for opKey := range ops {
+			keys = append(keys, opKey)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if matchPattern(pattern, key) && canRead(key, currentTx) {
+				fn(Event{Commit: commit, Key: key, Op: ops[key]})
+			}
+		}
+	}), nil
+}
+
+// watchCommits calls fn with the number and the operations of every commit to
+// the root transaction of currentTx. The returned function stops the calls.
+func watchCommits(currentTx Transaction, fn func(commit uint64, ops map[string]Op)) func() {
+	d := currentTx.db
+	if d == nil {
+		return func() {}
+	}
+
+	d.nextWatcher++
+	id := d.nextWatcher
+	d.watchers[id] = fn
+	return func() {
+		delete(d.watchers, id)
+	}
+}
+
+// notify calls the watchers, in the order they started watching,
+// with the operations committed to the root transaction.
+func (d *db) notify(ops map[string]Op) {
+	if d == nil || len(d.watchers) == 0 {
+		return
+	}
+
+	ids := []int{}
+	for id := range d.watchers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		if fn, watching := d.watchers[id]; watching {
+			fn(d.clock, ops)
+		}
+	}
+}
+
+// matchPattern tells if the key matches the pattern of a watcher.
+func matchPattern(pattern, key string) bool {
+	if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+		return strings.HasPrefix(key, prefix)
+	}
+	return key == pattern
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWatch(t *testing.T) {
+	cases := []struct {
+		name    string
+		pattern string
+		inputs  [][]string
+		events  []string
+	}{
+		{
+			name:    "write outside of a transaction",
+			pattern: "a",
+			inputs:  [][]string{{"WRITE", "a", "hello"}, {"WRITE", "b", "world"}, {"DELETE", "a"}},
+			events:  []string{"1 WRITE a hello", "3 DELETE a"},
+		},
+		{
+			name:    "prefix",
+			pattern: "user:*",
+			inputs:  [][]string{{"START"}, {"WRITE", "user:2", "bob"}, {"WRITE", "user:1", "alice"}, {"WRITE", "other", "x"}, {"COMMIT"}},
+			events:  []string{"1 WRITE user:1 alice", "1 WRITE user:2 bob"},
+		},
+		{
+			name:    "nested transaction committed to its parent",
+			pattern: "*",
+			inputs:  [][]string{{"START"}, {"START"}, {"WRITE", "a", "hello"}, {"COMMIT"}},
+			events:  nil,
+		},
+		{
+			name:    "nested transaction committed to root",
+			pattern: "*",
+			inputs:  [][]string{{"START"}, {"START"}, {"WRITE", "a", "hello"}, {"COMMIT"}, {"COMMIT"}},
+			events:  []string{"1 WRITE a hello"},
+		},
+		{
+			name:    "aborted transaction",
+			pattern: "*",
+			inputs:  [][]string{{"START"}, {"START"}, {"WRITE", "a", "hello"}, {"COMMIT"}, {"ABORT"}},
+			events:  nil,
+		},
+		{
+			name:    "rolled back savepoint",
+			pattern: "*",
+			inputs:  [][]string{{"START"}, {"WRITE", "a", "1"}, {"SAVEPOINT", "s1"}, {"WRITE", "b", "2"}, {"ROLLBACK", "TO", "s1"}, {"COMMIT", "ALL"}},
+			events:  []string{"1 WRITE a 1"},
+		},
+	}
+
+	for _, exp := range cases {
+		currentTx := NewRoot()
+		var events []string
+		Watch(currentTx, exp.pattern, func(event Event) {
+			events = append(events, event.String())
+		})
+		for _, input := range exp.inputs {
+			currentTx, _, _ = ExecuteOp(input[0], input[1:], currentTx)
+		}
+
+		// Are only the changes committed to the root transaction notified?
+		if !reflect.DeepEqual(events, exp.events) {
+			t.Fatalf("Failed %s.\nActual: %q.\nExpected: %q.\n", exp.name, events, exp.events)
+		}
+	}
+}
+
+func TestUnwatch(t *testing.T) {
+	root := NewRoot()
+	var events []string
+	unwatch, _ := Watch(root, "a", func(event Event) {
+		events = append(events, event.String())
+	})
+
+	// Setup: a transaction that fails to commit because of a conflict.
+	tx := startTx(root)
+	writeTx("a", "mine", tx)
+	writeTx("a", "hello", root)
+	commitTx(tx)
+	unwatch()
+	writeTx("a", "hello-again", root)
+
+	// Is neither the conflicting commit nor any change after unwatch notified?
+	if !reflect.DeepEqual(events, []string{"1 WRITE a hello"}) {
+		t.Fatalf("Failed.\nActual: %q.\nExpected: %q.\n", events, []string{"1 WRITE a hello"})
+	}
+}
+
+func TestWatchPermission(t *testing.T) {
+	currentTx := NewRoot()
+	currentTx.user = &User{Name: "bob", Permissions: map[string]Access{"": {Write: true}, "user:bob:": {Read: true}}}
+
+	cases := []struct {
+		pattern string
+		err     string
+	}{
+		{"user:bob:1", ""},
+		{"user:alice:1", "ERROR: WATCH called without read permission on user:alice:1.\n"},
+		{"user:*", ""},
+		{"secret:*", "ERROR: WATCH called without read permission on secret:*.\n"},
+	}
+
+	for _, exp := range cases {
+		_, err := Watch(currentTx, exp.pattern, func(event Event) {})
+
+		// Does watching keys the user may not read fail?
+		if (err == nil && exp.err != "") || (err != nil && err.Error() != exp.err) {
+			t.Fatalf("Failed %s.\nActual: %v.\nExpected: %q.\n", exp.pattern, err, exp.err)
+		}
+	}
+}